@@ -3,8 +3,9 @@
 set -e
 
 VERSION=$(git describe --tags --dirty)
+REVISION=$(git rev-parse --short HEAD)
 GO_BUILD_CMD="go build -a -installsuffix cgo"
-GO_BUILD_LDFLAGS="-s -w -X main.version=$VERSION"
+GO_BUILD_LDFLAGS="-s -w -X main.version=$VERSION -X main.revision=$REVISION"
 
 BUILD_PLATFORMS="linux"
 BUILD_ARCHS="amd64"
@@ -16,7 +17,7 @@ for OS in ${BUILD_PLATFORMS[@]}; do
     NAME="./kafka_connect_exporter-$OS-$ARCH"
     echo "Building for $OS/$ARCH"
     GOARCH=$ARCH GOOS=$OS CGO_ENABLED=0 $GO_BUILD_CMD -ldflags "$GO_BUILD_LDFLAGS"\
-     -o "release/$NAME" ./kafka_connect_exporter.go
+     -o "release/$NAME" .
     shasum -a 256 "release/$NAME" > "release/$NAME".sha256
   done
 done
\ No newline at end of file
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// check scrapes every exporter once and writes a line about each to w. It
+// returns false when any of the scrapes failed.
+func check(w io.Writer, exporters []*Exporter) bool {
+	ok := true
+	for _, exporter := range exporters {
+		registry := prometheus.NewRegistry()
+		if err := registry.Register(exporter); err != nil {
+			fmt.Fprintf(w, "%s: %v\n", exporter.URI, err)
+			ok = false
+			continue
+		}
+		families, err := registry.Gather()
+		if err != nil || !exporter.Ready() {
+			fmt.Fprintf(w, "%s: down\n", exporter.URI)
+			ok = false
+			continue
+		}
+
+		var count float64
+		countName := prometheus.BuildFQName(exporter.opts.Namespace, "connectors", "count")
+		for _, family := range families {
+			if family.GetName() == countName && len(family.GetMetric()) == 1 {
+				count = family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		fmt.Fprintf(w, "%s: up, %d connectors\n", exporter.URI, int(count))
+	}
+	return ok
+}
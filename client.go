@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/time/rate"
+)
+
+// ConnectClient is the part of the kafka connect REST API the exporter
+// depends on.
+type ConnectClient interface {
+	ClusterInfo(ctx context.Context) (*clusterInfo, error)
+	Connectors(ctx context.Context) (connectors, error)
+	ConnectorStatus(ctx context.Context, connector string) (*status, error)
+	ExpandedStatuses(ctx context.Context) ([]status, error)
+	ConnectorTopics(ctx context.Context, connector string) (topics []string, ok bool, err error)
+	ConnectorConfig(ctx context.Context, connector string) (map[string]string, error)
+	Plugins(ctx context.Context) ([]plugin, error)
+	RestartConnector(ctx context.Context, connector string) error
+	RestartTask(ctx context.Context, connector string, task int) error
+}
+
+// connectClient talks to kafka connect over HTTP.
+type connectClient struct {
+	base         *url.URL
+	userinfo     *url.Userinfo
+	opts         Options
+	client       *http.Client
+	limiter      *rate.Limiter
+	requests     prometheus.Counter
+	authMu       sync.Mutex
+	passwordFile *secretFile
+	tokenFile    *secretFile
+}
+
+// secretFile holds the content of a credentials file, which is only read
+// again once its modification time or size changes.
+type secretFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	content string
+}
+
+func newSecretFile(path string) *secretFile {
+	if path == "" {
+		return nil
+	}
+	return &secretFile{path: path}
+}
+
+func (f *secretFile) read() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.content, nil
+	}
+
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	f.content = strings.TrimSpace(string(content))
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return f.content, nil
+}
+
+// newConnectClient returns a client for uri. A unix:///path/to/socket uri
+// sends plain HTTP requests through the socket.
+func newConnectClient(uri *url.URL, opts Options) *connectClient {
+	dialer := &net.Dialer{Timeout: opts.DialTimeout}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		DisableCompression:    opts.NoCompression,
+		TLSClientConfig:       opts.TLSConfig,
+		TLSHandshakeTimeout:   opts.TLSTimeout,
+		ResponseHeaderTimeout: opts.HeaderTimeout,
+		MaxIdleConns:          opts.MaxConcurrency,
+		MaxIdleConnsPerHost:   opts.MaxConcurrency,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	if opts.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(opts.ProxyURL)
+	}
+	// The custom dialer and TLS config keep net/http from enabling HTTP/2 on
+	// its own, it has to be configured explicitly.
+	if opts.HTTP2 {
+		// ConfigureTransport adds h2 to the TLS config, which is shared
+		// with the other clients.
+		if transport.TLSClientConfig != nil {
+			transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+		}
+		if err := http2.ConfigureTransport(transport); err != nil {
+			log.Errorf("Can't enable HTTP/2: %v", err)
+		}
+	}
+
+	base := uri
+	if uri.Scheme == "unix" {
+		socket := uri.Path
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		base = &url.URL{Scheme: "http", Host: "localhost", RawQuery: uri.RawQuery}
+	}
+	// Credentials of the URI are sent as basic auth, keeping them out of the
+	// URIs that end up in logs and errors.
+	userinfo := base.User
+	if userinfo != nil {
+		stripped := *base
+		stripped.User = nil
+		base = &stripped
+	}
+
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if opts.RateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.RateLimit), 1)
+	}
+
+	return &connectClient{
+		base:         base,
+		userinfo:     userinfo,
+		opts:         opts,
+		passwordFile: newSecretFile(opts.PasswordFile),
+		tokenFile:    newSecretFile(opts.BearerTokenFile),
+		client:       &http.Client{Transport: transport},
+		limiter:      limiter,
+	}
+}
+
+// setCredentials replaces the credentials, secret files are read again even
+// if their path stays the same.
+func (c *connectClient) setCredentials(opts Options) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	c.opts.Username, c.opts.Password, c.opts.BearerToken = opts.Username, opts.Password, opts.BearerToken
+	c.passwordFile = newSecretFile(opts.PasswordFile)
+	c.tokenFile = newSecretFile(opts.BearerTokenFile)
+}
+
+// do sends the request once the rate limiter allows it.
+func (c *connectClient) do(request *http.Request) (*http.Response, error) {
+	if err := c.limiter.Wait(request.Context()); err != nil {
+		return nil, err
+	}
+	if c.requests != nil {
+		c.requests.Inc()
+	}
+	return c.client.Do(request)
+}
+
+func (c *connectClient) newRequest(ctx context.Context, method, uri string) (*http.Request, error) {
+	request, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", c.opts.UserAgent)
+	for name, value := range c.opts.Headers {
+		request.Header.Set(name, value)
+	}
+
+	c.authMu.Lock()
+	username, password, token := c.opts.Username, c.opts.Password, c.opts.BearerToken
+	passwordFile, tokenFile := c.passwordFile, c.tokenFile
+	c.authMu.Unlock()
+
+	if username != "" {
+		if passwordFile != nil {
+			if password, err = passwordFile.read(); err != nil {
+				return nil, fmt.Errorf("can't read password file: %v", err)
+			}
+		}
+		request.SetBasicAuth(username, password)
+	} else if c.userinfo != nil {
+		password, _ := c.userinfo.Password()
+		request.SetBasicAuth(c.userinfo.Username(), password)
+	}
+
+	if tokenFile != nil {
+		if token, err = tokenFile.read(); err != nil {
+			return nil, fmt.Errorf("can't read bearer token file: %v", err)
+		}
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return request, nil
+}
+
+// get issues a GET request, retrying connection errors and 5xx responses up
+// to Retries times with exponential backoff as long as ctx allows.
+func (c *connectClient) get(ctx context.Context, uri string) (*http.Response, error) {
+	request, err := c.newRequest(ctx, http.MethodGet, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		response, err := c.do(request)
+		if err != nil {
+			log.Debugf("GET %s failed after %v: %v", uri, time.Since(start), err)
+		} else {
+			log.Debugf("GET %s returned %s after %v", uri, response.Status, time.Since(start))
+		}
+		if attempt >= c.opts.Retries || (err == nil && response.StatusCode < 500) {
+			return response, err
+		}
+
+		if err == nil {
+			log.Debugf("Retrying %s after status %s, attempt %d of %d", uri, response.Status, attempt+1, c.opts.Retries)
+			err = fmt.Errorf("unexpected status %s from %s", response.Status, uri)
+			closeBody(response)
+		} else {
+			log.Debugf("Retrying %s after error %v, attempt %d of %d", uri, err, attempt+1, c.opts.Retries)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%v, no time left to retry", err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// maxDrainLength caps how much of an unread body is drained to keep the
+// connection, a larger rest is cheaper to drop together with it.
+const maxDrainLength = 64 << 10
+
+// closeBody drains what is left of the body before closing it, so the
+// connection goes back to the pool instead of being torn down.
+func closeBody(response *http.Response) {
+	if _, err := io.CopyN(ioutil.Discard, response.Body, maxDrainLength); err != nil && err != io.EOF {
+		log.Debugf("Can't drain response body: %v", err)
+	}
+	if err := response.Body.Close(); err != nil {
+		log.Errorf("Can't close connection to kafka connect: %v", err)
+	}
+}
+
+// statusError is returned for responses kafka connect answered with a non
+// 2xx status.
+type statusError struct {
+	code    int
+	status  string
+	uri     string
+	snippet string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %s from %s: %s", e.status, e.uri, e.snippet)
+}
+
+// decodeError is returned for 2xx responses whose body can't be decoded.
+type decodeError struct {
+	code int
+	uri  string
+	err  error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("can't decode response of %s: %v", e.uri, e.err)
+}
+
+// responseCode returns the HTTP status kafka connect answered with before
+// err happened, or 0 when no response arrived.
+func responseCode(err error) int {
+	switch err := err.(type) {
+	case *statusError:
+		return err.code
+	case *decodeError:
+		return err.code
+	}
+	return 0
+}
+
+// limitBody returns the body of response, failing reads once more than
+// MaxResponse bytes were read from it.
+func (c *connectClient) limitBody(response *http.Response) io.Reader {
+	if c.opts.MaxResponse <= 0 {
+		return response.Body
+	}
+	return &limitedReader{reader: response.Body, left: c.opts.MaxResponse, limit: c.opts.MaxResponse}
+}
+
+type limitedReader struct {
+	reader io.Reader
+	left   int64
+	limit  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Reading one byte past the limit tells a body of exactly the limit
+	// from a larger one.
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.reader.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, fmt.Errorf("body is larger than max-response-bytes %d", l.limit)
+	}
+	return n, err
+}
+
+// maxSnippetLength caps how much of an error response ends up in the error.
+const maxSnippetLength = 512
+
+// checkStatus returns an error carrying the start of the body for any non
+// 2xx response.
+func checkStatus(response *http.Response, uri string) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	snippet, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxSnippetLength))
+	return &statusError{
+		code:    response.StatusCode,
+		status:  response.Status,
+		uri:     uri,
+		snippet: strings.TrimSpace(string(snippet)),
+	}
+}
+
+// decode issues a GET request and passes a decoder reading straight from
+// the body of a 2xx response to fn.
+func (c *connectClient) decode(ctx context.Context, uri string, fn func(decoder *json.Decoder) error) error {
+	response, err := c.get(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer closeBody(response)
+
+	if err := checkStatus(response, uri); err != nil {
+		return err
+	}
+
+	if err := fn(json.NewDecoder(c.limitBody(response))); err != nil {
+		return &decodeError{code: response.StatusCode, uri: uri, err: err}
+	}
+
+	return nil
+}
+
+func (c *connectClient) getJSON(ctx context.Context, uri string, v interface{}) error {
+	return c.decode(ctx, uri, func(decoder *json.Decoder) error {
+		return decoder.Decode(v)
+	})
+}
+
+// endpoint joins path segments onto the scrape URI, keeping its path prefix
+// and query string. Segments are escaped, connector names may contain
+// slashes, spaces and other characters.
+func (c *connectClient) endpoint(query url.Values, segments ...string) string {
+	endpoint := *c.base
+
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	endpoint.RawPath = strings.TrimRight(c.base.EscapedPath(), "/") + "/" + strings.Join(escaped, "/")
+	endpoint.Path = strings.TrimRight(c.base.Path, "/") + "/" + strings.Join(segments, "/")
+
+	values := c.base.Query()
+	for name, value := range query {
+		values[name] = append(values[name], value...)
+	}
+	endpoint.RawQuery = values.Encode()
+
+	return endpoint.String()
+}
+
+func (c *connectClient) connectorURI(connector, endpoint string) string {
+	return c.endpoint(nil, "connectors", connector, endpoint)
+}
+
+func (c *connectClient) ConnectorStatus(ctx context.Context, connector string) (*status, error) {
+	var connectorStatus status
+	if err := c.getJSON(ctx, c.connectorURI(connector, "status"), &connectorStatus); err != nil {
+		return nil, err
+	}
+
+	return &connectorStatus, nil
+}
+
+// ExpandedStatuses gets the status of every connector with a single request,
+// which needs kafka connect 2.3 or newer.
+func (c *connectClient) ExpandedStatuses(ctx context.Context) ([]status, error) {
+	var statuses []status
+	err := c.decode(ctx, c.endpoint(url.Values{"expand": {"status", "info"}}, "connectors"), func(decoder *json.Decoder) error {
+		var err error
+		statuses, err = decodeExpanded(decoder)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses, nil
+}
+
+// decodeExpanded reads the statuses from the object the expand API answers
+// with one connector at a time, the answer of a large cluster is never held
+// in memory whole.
+func decodeExpanded(decoder *json.Decoder) ([]status, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if token != json.Delim('{') {
+		return nil, fmt.Errorf("expected an object of connectors, got %v", token)
+	}
+
+	var statuses []status
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var connector expandedConnector
+		if err := decoder.Decode(&connector); err != nil {
+			return nil, err
+		}
+		if connector.Status.Name == "" {
+			connector.Status.Name = key.(string)
+		}
+		if connector.Status.Type == "" {
+			connector.Status.Type = connector.Info.Type
+		}
+		connector.Status.Config = connector.Info.Config
+		statuses = append(statuses, connector.Status)
+	}
+
+	// The closing brace, anything malformed before it fails here.
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// ConnectorTopics returns the active topics of a connector, or ok false when
+// kafka connect is older than 2.5 and doesn't know the topics endpoint.
+func (c *connectClient) ConnectorTopics(ctx context.Context, connector string) (topics []string, ok bool, err error) {
+	uri := c.connectorURI(connector, "topics")
+	response, err := c.get(ctx, uri)
+	if err != nil {
+		return nil, false, err
+	}
+	defer closeBody(response)
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if err := checkStatus(response, uri); err != nil {
+		return nil, false, err
+	}
+
+	var active map[string]struct {
+		Topics []string `json:"topics"`
+	}
+	if err := json.NewDecoder(c.limitBody(response)).Decode(&active); err != nil {
+		return nil, false, &decodeError{code: response.StatusCode, uri: uri, err: err}
+	}
+
+	return active[connector].Topics, true, nil
+}
+
+func (c *connectClient) ClusterInfo(ctx context.Context) (*clusterInfo, error) {
+	var info clusterInfo
+	if err := c.getJSON(ctx, c.endpoint(nil), &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// Connectors lists the connector names. Besides the plain array it accepts
+// the object keyed by connector name that the expand API answers with.
+func (c *connectClient) Connectors(ctx context.Context) (connectors, error) {
+	var connectorsList connectors
+	err := c.decode(ctx, c.endpoint(nil, "connectors"), func(decoder *json.Decoder) error {
+		var err error
+		connectorsList, err = decodeConnectors(decoder)
+		return err
+	})
+	return connectorsList, err
+}
+
+// decodeConnectors reads the names from an array of names or from the keys
+// of an object, one value at a time, without a copy of the whole body.
+func decodeConnectors(decoder *json.Decoder) (connectors, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	var connectorsList connectors
+	switch token {
+	case nil:
+		return nil, nil
+	case json.Delim('['):
+		for decoder.More() {
+			var name string
+			if err := decoder.Decode(&name); err != nil {
+				return nil, err
+			}
+			connectorsList = append(connectorsList, name)
+		}
+	case json.Delim('{'):
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return nil, err
+			}
+			connectorsList = append(connectorsList, key.(string))
+		}
+		sort.Strings(connectorsList)
+	default:
+		return nil, fmt.Errorf("expected an array or object of connectors, got %v", token)
+	}
+
+	// The closing bracket, anything malformed before it fails here.
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return connectorsList, nil
+}
+
+func (c *connectClient) ConnectorConfig(ctx context.Context, connector string) (map[string]string, error) {
+	var config map[string]string
+	if err := c.getJSON(ctx, c.connectorURI(connector, "config"), &config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (c *connectClient) Plugins(ctx context.Context) ([]plugin, error) {
+	var plugins []plugin
+	if err := c.getJSON(ctx, c.endpoint(nil, "connector-plugins"), &plugins); err != nil {
+		return nil, err
+	}
+
+	return plugins, nil
+}
+
+// post issues a POST request without a body, it isn't retried.
+func (c *connectClient) post(ctx context.Context, uri string) error {
+	request, err := c.newRequest(ctx, http.MethodPost, uri)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.do(request)
+	if err != nil {
+		return err
+	}
+	defer closeBody(response)
+
+	return checkStatus(response, uri)
+}
+
+// RestartConnector restarts the connector together with its failed tasks,
+// kafka connect older than 3.0 ignores the parameters and restarts only the
+// connector.
+func (c *connectClient) RestartConnector(ctx context.Context, connector string) error {
+	return c.post(ctx, c.endpoint(url.Values{"includeTasks": {"true"}, "onlyFailed": {"true"}}, "connectors", connector, "restart"))
+}
+
+func (c *connectClient) RestartTask(ctx context.Context, connector string, task int) error {
+	return c.post(ctx, c.endpoint(nil, "connectors", connector, "tasks", strconv.Itoa(task), "restart"))
+}
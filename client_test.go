@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a kafka connect served by handler and
+// the server, which the caller closes.
+func newTestClient(t *testing.T, handler http.Handler) (*connectClient, *httptest.Server) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	uri, err := url.Parse(server.URL)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return newConnectClient(uri, testOptions()), server
+}
+
+// respond answers every request for path with code and body, anything else
+// with 404.
+func respond(path string, code int, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	})
+}
+
+func TestConnectorStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     int
+		body     string
+		want     *status
+		wantCode int
+	}{
+		{
+			name: "success",
+			code: http.StatusOK,
+			body: `{"name":"a","connector":{"state":"RUNNING","worker_id":"w:8083"},"tasks":[{"id":0,"state":"FAILED","worker_id":"w:8083","trace":"boom"}],"type":"sink"}`,
+			want: &status{
+				Name:      "a",
+				Connector: connector{State: "RUNNING", WorkerId: "w:8083"},
+				Tasks:     []task{{State: "FAILED", Id: 0, WorkerId: "w:8083", Trace: "boom"}},
+				Type:      "sink",
+			},
+		},
+		{
+			name:     "non 2xx",
+			code:     http.StatusConflict,
+			body:     `{"error_code":409,"message":"rebalance in progress"}`,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "server error",
+			code:     http.StatusInternalServerError,
+			body:     `{"error_code":500}`,
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "malformed JSON",
+			code:     http.StatusOK,
+			body:     `{"name":"a","connector":`,
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newTestClient(t, respond("/connectors/a/status", test.code, test.body))
+			defer server.Close()
+			got, err := client.ConnectorStatus(context.Background(), "a")
+			if test.want != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, test.want) {
+					t.Fatalf("got %+v, want %+v", got, test.want)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("got %+v, want an error", got)
+			}
+			if code := responseCode(err); code != test.wantCode {
+				t.Fatalf("got code %d from %v, want %d", code, err, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestConnectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		body    string
+		want    connectors
+		wantErr bool
+	}{
+		{name: "success", code: http.StatusOK, body: `["b","a"]`, want: connectors{"b", "a"}},
+		{name: "non 2xx", code: http.StatusUnauthorized, body: `{"error_code":401}`, wantErr: true},
+		{name: "malformed JSON", code: http.StatusOK, body: `["a",`, wantErr: true},
+		{name: "not a list", code: http.StatusOK, body: `"a"`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newTestClient(t, respond("/connectors", test.code, test.body))
+			defer server.Close()
+			got, err := client.Connectors(context.Background())
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScrapeOverHTTP(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/connectors", respond("/connectors", http.StatusOK, `["a","busy","broken"]`))
+	mux.Handle("/connectors/a/status", respond("/connectors/a/status", http.StatusOK, `{"name":"a","connector":{"state":"RUNNING","worker_id":"w:8083"},"tasks":[],"type":"sink"}`))
+	mux.Handle("/connectors/busy/status", respond("/connectors/busy/status", http.StatusConflict, `{"error_code":409}`))
+	mux.Handle("/connectors/broken/status", respond("/connectors/broken/status", http.StatusOK, `{"name":`))
+	mux.Handle("/", respond("/", http.StatusOK, `{"version":"3.4.0","commit":"abc","kafka_cluster_id":"xyz"}`))
+
+	client, server := newTestClient(t, mux)
+	defer server.Close()
+	values := gather(t, NewExporterWithClient(client, "test", testOptions()))
+
+	want := map[string]float64{
+		"kafka_connect_up":               1,
+		"kafka_connect_connectors_count": 3,
+		`kafka_connect_connector_scrape_status{code="200",connector="a"}`:      1,
+		`kafka_connect_connector_scrape_status{code="409",connector="busy"}`:   1,
+		`kafka_connect_connector_scrape_status{code="200",connector="broken"}`: 1,
+		`kafka_connect_connector_scrape_errors_total{connector="busy"}`:        1,
+		`kafka_connect_connector_scrape_errors_total{connector="broken"}`:      1,
+		`kafka_connect_connector_tasks_count{connector="a"}`:                   0,
+	}
+	for key, wantValue := range want {
+		if got, ok := values[key]; !ok || got != wantValue {
+			t.Errorf("%s = %v (exported %v), want %v", key, got, ok, wantValue)
+		}
+	}
+}
+
+func TestErrorResponsesReleaseConnections(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/connectors/conflict/status", respond("/connectors/conflict/status", http.StatusConflict, `{"error_code":409}`))
+	mux.Handle("/connectors/failing/status", respond("/connectors/failing/status", http.StatusInternalServerError, `{"error_code":500}`))
+	mux.Handle("/connectors/malformed/status", respond("/connectors/malformed/status", http.StatusOK, `{"name":"malformed"`+strings.Repeat(" ", 4096)))
+	mux.Handle("/connectors/large/status", respond("/connectors/large/status", http.StatusOK, `{"name":"`+strings.Repeat("x", 4096)+`"}`))
+
+	server := httptest.NewUnstartedServer(mux)
+	var mu sync.Mutex
+	opened := 0
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			opened++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	uri, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.MaxResponse = 1024
+	client := newConnectClient(uri, opts)
+
+	// A body that isn't drained and closed keeps its connection busy, the
+	// next request then has to open another one.
+	for i := 0; i < 10; i++ {
+		for _, name := range []string{"conflict", "failing", "malformed", "large"} {
+			if _, err := client.ConnectorStatus(context.Background(), name); err == nil {
+				t.Fatalf("status of %s didn't fail", name)
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if opened != 1 {
+		t.Fatalf("requests opened %d connections, want 1", opened)
+	}
+}
+
+func testEndpoint(t *testing.T, scrapeURI string, segments ...string) string {
+	t.Helper()
+
+	uri, err := url.Parse(scrapeURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newConnectClient(uri, testOptions()).endpoint(nil, segments...)
+}
+
+func TestEndpointTrailingSlash(t *testing.T) {
+	tests := []struct {
+		scrapeURI string
+		want      string
+	}{
+		{"http://connect:8083", "http://connect:8083/connectors"},
+		{"http://connect:8083/", "http://connect:8083/connectors"},
+		{"http://connect:8083//", "http://connect:8083/connectors"},
+		{"http://connect:8083/prefix/", "http://connect:8083/prefix/connectors"},
+		{"http://connect:8083/prefix", "http://connect:8083/prefix/connectors"},
+	}
+
+	for _, test := range tests {
+		if got := testEndpoint(t, test.scrapeURI, "connectors"); got != test.want {
+			t.Errorf("endpoint of %s = %s, want %s", test.scrapeURI, got, test.want)
+		}
+	}
+}
+
+func TestEndpointEscapesConnectorName(t *testing.T) {
+	tests := []struct {
+		connector string
+		want      string
+	}{
+		{"plain", "http://connect:8083/connectors/plain/status"},
+		{"my connector/v2", "http://connect:8083/connectors/my%20connector%2Fv2/status"},
+		{"a?b#c%d", "http://connect:8083/connectors/a%3Fb%23c%25d/status"},
+	}
+
+	for _, test := range tests {
+		if got := testEndpoint(t, "http://connect:8083/", "connectors", test.connector, "status"); got != test.want {
+			t.Errorf("status endpoint of %q = %s, want %s", test.connector, got, test.want)
+		}
+	}
+
+	// The escaped name has to arrive as one path segment.
+	var requested string
+	client, server := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.EscapedPath()
+		w.Write([]byte(`{"name":"my connector/v2","connector":{"state":"RUNNING"},"tasks":[]}`))
+	}))
+	defer server.Close()
+	connectorStatus, err := client.ConnectorStatus(context.Background(), "my connector/v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/connectors/my%20connector%2Fv2/status"; requested != want {
+		t.Fatalf("requested %s, want %s", requested, want)
+	}
+	if connectorStatus.Name != "my connector/v2" {
+		t.Fatalf("got status of %q", connectorStatus.Name)
+	}
+}
+
+func TestEndpointBasePath(t *testing.T) {
+	tests := []struct {
+		scrapeURI string
+		segments  []string
+		want      string
+	}{
+		{"https://gw.example.com/kafka-connect/", []string{"connectors"}, "https://gw.example.com/kafka-connect/connectors"},
+		{"https://gw.example.com/team/a/kafka-connect", []string{"connectors", "x", "status"}, "https://gw.example.com/team/a/kafka-connect/connectors/x/status"},
+		{"https://gw.example.com/team%2Fa/connect/", []string{"connectors", "x y"}, "https://gw.example.com/team%2Fa/connect/connectors/x%20y"},
+		{"https://gw.example.com/kafka-connect/?tenant=a", []string{"connectors"}, "https://gw.example.com/kafka-connect/connectors?tenant=a"},
+		{"https://gw.example.com/kafka-connect/", nil, "https://gw.example.com/kafka-connect/"},
+	}
+
+	for _, test := range tests {
+		if got := testEndpoint(t, test.scrapeURI, test.segments...); got != test.want {
+			t.Errorf("endpoint %v of %s = %s, want %s", test.segments, test.scrapeURI, got, test.want)
+		}
+	}
+
+	// Every request of a scrape goes below the base path.
+	var mu sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/team/a/kafka-connect/connectors":
+			w.Write([]byte(`["x"]`))
+		case "/team/a/kafka-connect/connectors/x/status":
+			w.Write([]byte(`{"name":"x","connector":{"state":"RUNNING"},"tasks":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	base, err := url.Parse(server.URL + "/team/a/kafka-connect/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := gather(t, NewExporterWithClient(newConnectClient(base, testOptions()), "test", testOptions()))
+	if _, ok := values[`kafka_connect_connector_tasks_count{connector="x"}`]; !ok || values["kafka_connect_up"] != 1 {
+		t.Fatalf("scrape below the base path failed, requested %v", requested)
+	}
+	for _, path := range requested {
+		if !strings.HasPrefix(path, "/team/a/kafka-connect/") {
+			t.Errorf("requested %s outside of the base path", path)
+		}
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.String())
+		mu.Unlock()
+		if r.URL.Host != "connect.invalid:8083" || r.URL.Path != "/connectors" {
+			http.Error(w, "unexpected request", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`["a"]`))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse("http://connect.invalid:8083")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.ProxyURL = proxyURL
+
+	got, err := newConnectClient(uri, opts).Connectors(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, connectors{"a"}) {
+		t.Fatalf("got %v through the proxy, want [a]", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"http://connect.invalid:8083/connectors"}; !reflect.DeepEqual(proxied, want) {
+		t.Fatalf("proxy got %v, want %v", proxied, want)
+	}
+}
+
+func TestConnectorsResponseShapes(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want connectors
+	}{
+		{"array", `["b","a"]`, connectors{"b", "a"}},
+		{"empty array", `[]`, nil},
+		{"null", `null`, nil},
+		{"object", `{"b":{"status":{"name":"b"}},"a":{"status":{"name":"a"},"info":{"type":"sink"}}}`, connectors{"a", "b"}},
+		{"empty object", `{}`, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newTestClient(t, respond("/connectors", http.StatusOK, test.body))
+			defer server.Close()
+
+			got, err := client.Connectors(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.want) || (len(got) > 0 && !reflect.DeepEqual(got, test.want)) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+
+			values := gather(t, NewExporterWithClient(client, "test", testOptions()))
+			if values["kafka_connect_up"] != 1 || values["kafka_connect_connectors_count"] != float64(len(test.want)) {
+				t.Fatalf("got up %v and connectors_count %v, want 1 and %d",
+					values["kafka_connect_up"], values["kafka_connect_connectors_count"], len(test.want))
+			}
+		})
+	}
+}
+
+// expandedBody is an expand API answer for n connectors with two tasks each.
+func expandedBody(n int) []byte {
+	var body bytes.Buffer
+	body.WriteString("{")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `"connector-%d":{"status":{"name":"connector-%d","connector":{"state":"RUNNING","worker_id":"worker-%d:8083"},`+
+			`"tasks":[{"id":0,"state":"RUNNING","worker_id":"worker-1:8083"},{"id":1,"state":"FAILED","worker_id":"worker-2:8083","trace":"%s"}],"type":"sink"},`+
+			`"info":{"name":"connector-%d","config":{"connector.class":"io.confluent.connect.s3.S3SinkConnector","tasks.max":"2","topics":"a,b,c"},"tasks":[],"type":"sink"}}`,
+			i, i, i%5, strings.Repeat("at org.apache.kafka.connect.Foo\\n", 20), i)
+	}
+	body.WriteString("}")
+	return body.Bytes()
+}
+
+func BenchmarkDecodeConnectors(b *testing.B) {
+	body := expandedBody(2000)
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeConnectors(json.NewDecoder(bytes.NewReader(body))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// buffered is how the response was decoded before, reading the whole
+	// body and unmarshalling it.
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			raw, err := ioutil.ReadAll(bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var expanded map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &expanded); err != nil {
+				b.Fatal(err)
+			}
+			connectorsList := make(connectors, 0, len(expanded))
+			for name := range expanded {
+				connectorsList = append(connectorsList, name)
+			}
+			sort.Strings(connectorsList)
+		}
+	})
+}
+
+func BenchmarkDecodeExpanded(b *testing.B) {
+	body := expandedBody(2000)
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeExpanded(json.NewDecoder(bytes.NewReader(body))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			raw, err := ioutil.ReadAll(bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var expanded map[string]expandedConnector
+			if err := json.Unmarshal(raw, &expanded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestURICredentials(t *testing.T) {
+	var username, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+		http.Error(w, `{"error_code":403}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	uri, err := url.Parse(strings.Replace(server.URL, "http://", "http://user:secret@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newConnectClient(uri, testOptions()).Connectors(context.Background())
+	if err == nil {
+		t.Fatal("got no error for a 403")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Fatalf("error shows the password: %v", err)
+	}
+	if username != "user" || password != "secret" {
+		t.Fatalf("got basic auth %q:%q, want user:secret", username, password)
+	}
+}
+
+func TestOversizedResponseIsNotDrained(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"`))
+		chunk := []byte(strings.Repeat("x", 32<<10))
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	uri, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.MaxResponse = 1024
+	client := newConnectClient(uri, opts)
+
+	// Cancelling stops the read on failure, the server can't close before.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ConnectorStatus(ctx, "endless")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("endless response was accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still reading the endless response after max-response-bytes tripped")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type config struct {
+	ScrapeURIs       []string      `yaml:"scrape_uris"`
+	ClusterNames     []string      `yaml:"cluster_names"`
+	ScrapeTimeout    time.Duration `yaml:"scrape_timeout"`
+	ConnectorInclude string        `yaml:"connector_include"`
+	ConnectorExclude string        `yaml:"connector_exclude"`
+	Auth             authConfig    `yaml:"auth"`
+	TLS              tlsConfig     `yaml:"tls"`
+}
+
+type authConfig struct {
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	PasswordFile    string `yaml:"password_file"`
+	BearerToken     string `yaml:"bearer_token"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	ConfluentKey    string `yaml:"confluent_api_key"`
+	ConfluentSecret string `yaml:"confluent_api_secret"`
+}
+
+type tlsConfig struct {
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	CA                 string `yaml:"ca"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func loadConfig(path string) (*config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read config file: %v", err)
+	}
+
+	cfg := &config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("can't parse config file %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// flagValues maps the non-empty settings of the config file onto the flags
+// they correspond to, repeatable flags get one value per entry.
+func (c *config) flagValues() map[string][]string {
+	values := map[string][]string{
+		"scrape-uri":   c.ScrapeURIs,
+		"cluster-name": c.ClusterNames,
+	}
+	for name, value := range map[string]string{
+		"scrape-username":          c.Auth.Username,
+		"scrape-password":          c.Auth.Password,
+		"scrape-password-file":     c.Auth.PasswordFile,
+		"scrape-bearer-token":      c.Auth.BearerToken,
+		"scrape-bearer-token-file": c.Auth.BearerTokenFile,
+		"confluent-api-key":        c.Auth.ConfluentKey,
+		"confluent-api-secret":     c.Auth.ConfluentSecret,
+		"connector-include":        c.ConnectorInclude,
+		"connector-exclude":        c.ConnectorExclude,
+		"scrape-tls-cert":          c.TLS.Cert,
+		"scrape-tls-key":           c.TLS.Key,
+		"scrape-tls-ca":            c.TLS.CA,
+	} {
+		if value != "" {
+			values[name] = []string{value}
+		}
+	}
+	if c.ScrapeTimeout != 0 {
+		values["scrape-timeout"] = []string{c.ScrapeTimeout.String()}
+	}
+	if c.TLS.InsecureSkipVerify {
+		values["scrape-tls-insecure"] = []string{strconv.FormatBool(c.TLS.InsecureSkipVerify)}
+	}
+
+	for name, value := range values {
+		if len(value) == 0 {
+			delete(values, name)
+		}
+	}
+
+	return values
+}
+
+// applyConfig sets every flag that was not given on the command line or
+// through the environment from the config file.
+func applyConfig(flags *flag.FlagSet, cfg *config) error {
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, values := range cfg.flagValues() {
+		if explicit[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := flags.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value %q for %s in config file: %v", value, name, err)
+			}
+		}
+	}
+
+	return nil
+}
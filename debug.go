@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type debugConnectors struct {
+	URI        string     `json:"uri"`
+	ScrapedAt  *time.Time `json:"scraped_at,omitempty"`
+	Connectors []status   `json:"connectors"`
+}
+
+// debugConnectorsHandler serves the connector statuses the exporters parsed
+// during their last scrape, without scraping again. Connector configs are
+// left out, they may hold secrets.
+func debugConnectorsHandler(exporters []*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dump := make([]debugConnectors, 0, len(exporters))
+		for _, exporter := range exporters {
+			statuses, scrapedAt := exporter.LastStatuses()
+			entry := debugConnectors{URI: exporter.URI, Connectors: statuses}
+			if !scrapedAt.IsZero() {
+				entry.ScrapedAt = &scrapedAt
+			}
+			if entry.Connectors == nil {
+				entry.Connectors = []status{}
+			}
+			dump = append(dump, entry)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(dump); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
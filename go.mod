@@ -3,6 +3,9 @@ module github.com/wakeful/kafka_connect_exporter
 go 1.12
 
 require (
-	github.com/prometheus/client_golang v0.9.3
-	github.com/prometheus/common v0.4.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/common v0.10.0
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	gopkg.in/yaml.v2 v2.2.5
 )
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,212 +29,2048 @@ import (
 	"github.com/prometheus/common/log"
 )
 
-const nameSpace = "kafka_connect"
+const (
+	nameSpace    = "kafka_connect"
+	retryBackoff = 100 * time.Millisecond
+)
 
 var (
 	version    = "dev"
+	revision   = "unknown"
 	versionUrl = "https://github.com/wakeful/kafka_connect_exporter"
+	startTime  = time.Now()
 
-	showVersion   = flag.Bool("version", false, "show version and exit")
-	listenAddress = flag.String("listen-address", ":8080", "Address on which to expose metrics.")
-	metricsPath   = flag.String("telemetry-path", "/metrics", "Path under which to expose metrics.")
-	scrapeURI     = flag.String("scrape-uri", "http://127.0.0.1:8080", "URI on which to scrape kafka connect.")
-
-	isConnectorRunning = prometheus.NewDesc(
-		prometheus.BuildFQName(nameSpace, "connector", "state_running"),
-		"is the connector running?",
-		[]string{"connector", "state", "worker"}, nil)
-	areConnectorTasksRunning = prometheus.NewDesc(
-		prometheus.BuildFQName(nameSpace, "connector", "tasks_state"),
-		"the state of tasks. 0-failed, 1-running, 2-unassigned, 3-paused",
-		[]string{"connector", "state", "worker_id", "id"}, nil)
+	showVersion           = flag.Bool("version", false, "show version and exit")
+	dropWorkerLabel       = flag.Bool("drop-worker-label", false, "Leave the worker labels and the per worker metrics out, so connectors moving between workers don't create new series.")
+	probeEnabled          = flag.Bool("enable-probe", false, "Serve /probe?target=<uri>, scraping any kafka connect named in the query string with the configured credentials.")
+	probeMaxTargets       = flag.Int("probe-max-targets", 100, "Maximum number of probe targets kept between probes, the least recently probed is dropped first.")
+	debugEndpoints        = flag.Bool("enable-debug-endpoints", false, "Serve the connector statuses of the last scrape as JSON under /debug/connectors.")
+	runtimeMetrics        = flag.Bool("enable-runtime-metrics", false, "Export the go_* and process_* metrics of the exporter itself.")
+	checkOnly             = flag.Bool("check", false, "Scrape every kafka connect once, print a summary and exit, non-zero when a scrape failed.")
+	configFile            = flag.String("config.file", "", "Path to a YAML configuration file, explicit flags override its values.")
+	noLandingPage         = flag.Bool("no-landing-page", false, "Redirect / to the metrics path instead of serving a landing page.")
+	shutdownTimeout       = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests on shutdown.")
+	webTLSCert            = flag.String("web.tls-cert", "", "Certificate file to serve the exporter over TLS.")
+	webTLSKey             = flag.String("web.tls-key", "", "Key file to serve the exporter over TLS.")
+	webTLSClientCA        = flag.String("web.tls-client-ca", "", "CA bundle to verify client certificates against, requires web.tls-cert.")
+	webAuthUsername       = flag.String("web.auth-username", "", "Username required to access the metrics path.")
+	webAuthPassword       = flag.String("web.auth-password", "", "Password required to access the metrics path.")
+	logLevel              = flag.String("log.level", "info", "Only log messages with the given severity or above, one of: debug, info, warn, error.")
+	logFormat             = flag.String("log.format", "logfmt", "Output format of log messages, one of: logfmt, json.")
+	listenAddress         = flag.String("listen-address", ":8080", "Address on which to expose metrics.")
+	disableRootRedirect   = flag.Bool("disable-root-redirect", false, "Don't serve anything on /, neither the landing page nor the redirect.")
+	metricsPaths          stringSlice
+	scrapeURIs            stringSlice
+	clusterNames          stringSlice
+	scrapeUsername        = flag.String("scrape-username", "", "Username for basic auth against kafka connect.")
+	scrapePassword        = flag.String("scrape-password", "", "Password for basic auth against kafka connect.")
+	scrapePasswordFile    = flag.String("scrape-password-file", "", "File containing the password for basic auth, re-read when it changes.")
+	confluentAPIKey       = flag.String("confluent-api-key", "", "Confluent Cloud API key, for scraping a managed Connect cluster.")
+	confluentAPISecret    = flag.String("confluent-api-secret", "", "Confluent Cloud API secret, for scraping a managed Connect cluster.")
+	scrapeBearerToken     = flag.String("scrape-bearer-token", "", "Bearer token for authenticating against kafka connect.")
+	scrapeBearerTokenFile = flag.String("scrape-bearer-token-file", "", "File containing the bearer token, re-read when it changes.")
+	scrapeTLSCert         = flag.String("scrape-tls-cert", "", "Client certificate file for mTLS against kafka connect.")
+	scrapeTLSKey          = flag.String("scrape-tls-key", "", "Client key file for mTLS against kafka connect.")
+	scrapeTLSCA           = flag.String("scrape-tls-ca", "", "CA bundle file used to verify the kafka connect certificate.")
+	scrapeUserAgent       = flag.String("scrape-user-agent", "", "User-Agent header sent to kafka connect. (default \"kafka_connect_exporter/<version>\")")
+	scrapeGzip            = flag.Bool("scrape-gzip", true, "Ask kafka connect for gzip compressed responses.")
+	scrapeHTTP2           = flag.Bool("scrape-http2", false, "Offer HTTP/2 when connecting to kafka connect over TLS.")
+	scrapeProxyURL        = flag.String("scrape-proxy-url", "", "Proxy to reach kafka connect through, overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY.")
+	scrapeTLSInsecure     = flag.Bool("scrape-tls-insecure", false, "Skip verification of the kafka connect certificate.")
+	scrapeHeaders         stringSlice
+	constLabelSpecs       stringSlice
+	taskStateMapping      stringSlice
+	collectTopics         = flag.Bool("collect-topics", false, "Also collect the active topics of every connector (kafka connect 2.5+).")
+	collectConfig         = flag.Bool("collect-config", false, "Also collect the configuration of every connector.")
+	collectPlugins        = flag.Bool("collect-plugins", false, "Also collect the connector plugins installed on kafka connect.")
+	minimal               = flag.Bool("minimal", false, "Only fetch the connector list and export up and connectors_count.")
+	disableTaskMetrics    = flag.Bool("disable-task-metrics", false, "Don't export per task metrics, only the per connector and cluster totals.")
+	useExpand             = flag.Bool("use-expand", false, "Fetch all connector statuses with a single request to the expand API (kafka connect 2.3+).")
+	minConnectors         = flag.Int("min-connectors", 0, "Warn and count kafka_connect_connector_count_below_threshold_total when fewer connectors are listed.")
+	maxResponseBytes      = flag.Int64("max-response-bytes", 0, "Maximum size of a response from kafka connect, larger ones fail the request, 0 means no limit.")
+	maxTopics             = flag.Int("max-topics-per-connector", 100, "Maximum number of connector_topic series per connector, 0 means no limit.")
+	maxTraceLength        = flag.Int("max-trace-length", 200, "Maximum number of characters of a failure trace to expose, 0 means no limit.")
+	scrapeRetries         = flag.Int("scrape-retries", 0, "Number of times a failed request to kafka connect is retried with exponential backoff.")
+	maxConcurrency        = flag.Int("max-concurrency", 10, "Maximum number of concurrent requests to kafka connect.")
+	scrapeRateLimit       = flag.Float64("scrape-rate-limit", 0, "Maximum number of requests per second to each kafka connect, 0 means no limit.")
+	connectorInclude      = flag.String("connector-include", "", "Only scrape connectors whose name matches this regex.")
+	connectorExclude      = flag.String("connector-exclude", "", "Don't scrape connectors whose name matches this regex.")
+	metricNamespace       = flag.String("metric-namespace", nameSpace, "Prefix of all exported metric names.")
+	autoRestartFailed     = flag.Bool("auto-restart-failed", false, "Restart failed connectors and tasks found while scraping.")
+	autoRestartCooldown   = flag.Duration("auto-restart-cooldown", 10*time.Minute, "Minimum time between two restarts of the same connector.")
+	cacheTTL              = flag.Duration("cache-ttl", 0, "Serve the metrics of the previous scrape while they are younger than this, 0 disables caching.")
+	scrapeDialTimeout     = flag.Duration("scrape-dial-timeout", 0, "Timeout for connecting to kafka connect, 0 leaves it to scrape-timeout.")
+	scrapeTLSTimeout      = flag.Duration("scrape-tls-handshake-timeout", 0, "Timeout for the TLS handshake with kafka connect, 0 leaves it to scrape-timeout.")
+	scrapeHeaderTimeout   = flag.Duration("scrape-response-header-timeout", 0, "Timeout for kafka connect to send the response headers, 0 leaves it to scrape-timeout.")
+	connectorTimeout      = flag.Duration("connector-timeout", 0, "Timeout for each request about a single connector, 0 leaves it to scrape-timeout.")
+	scrapeTimeout         = flag.Duration("scrape-timeout", 3*time.Second, "Time budget for a complete scrape of kafka connect.")
 )
 
+// taskStates are the states every task reports a series for in the one-hot
+// task_state metric, a state missing here is still exported when seen.
+var taskStates = []string{"running", "failed", "paused", "unassigned", "restarting", "destroyed"}
+
+// connectorStates always get a connectors_state_total series, other states
+// only while a connector is in them.
+var connectorStates = []string{"running", "failed", "paused", "unassigned", "restarting"}
+
+// taskStateCodes is the default value of tasks_state for each state, states
+// missing here are reported as failed. -task-state-mapping overrides it.
+var taskStateCodes = map[string]float64{
+	"failed":     0,
+	"running":    1,
+	"unassigned": 2,
+	"paused":     3,
+	"restarting": 4,
+	"destroyed":  5,
+}
+
+var landingPage = template.Must(template.New("landing").Parse(`<html>
+<head><title>Kafka Connect Exporter</title></head>
+<body>
+<h1>Kafka Connect Exporter</h1>
+<p>Version: {{.Version}} ({{.Revision}})</p>
+<p><a href="{{.MetricsPath}}">Metrics</a></p>
+<h2>Clusters</h2>
+<ul>
+{{range .Exporters}}<li>{{.URI}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 type connectors []string
 
 type status struct {
 	Name      string    `json:"name"`
 	Connector connector `json:"connector"`
 	Tasks     []task    `json:"tasks"`
+	Type      string    `json:"type"`
+	// Config is only filled from the expand API, it isn't part of /status.
+	Config map[string]string `json:"-"`
+}
+
+type expandedConnector struct {
+	Status status        `json:"status"`
+	Info   connectorInfo `json:"info"`
+}
+
+type connectorInfo struct {
+	Type   string            `json:"type"`
+	Config map[string]string `json:"config"`
 }
 
 type connector struct {
 	State    string `json:"state"`
 	WorkerId string `json:"worker_id"`
+	Trace    string `json:"trace"`
 }
 
 type task struct {
-	State    string  `json:"state"`
-	Id       float64 `json:"id"`
-	WorkerId string  `json:"worker_id"`
+	State    string             `json:"state"`
+	Id       float64            `json:"id"`
+	WorkerId string             `json:"worker_id"`
+	Trace    string             `json:"trace"`
+	Fields   map[string]float64 `json:"-"`
+}
+
+// UnmarshalJSON keeps the numeric fields of a task status besides id in
+// Fields, so fields added by newer kafka connect versions get exported
+// without knowing them up front.
+func (t *task) UnmarshalJSON(data []byte) error {
+	type plainTask task
+	if err := json.Unmarshal(data, (*plainTask)(t)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, raw := range fields {
+		// A null decodes into a float without an error, it is no value.
+		var value float64
+		if name == "id" || string(raw) == "null" || json.Unmarshal(raw, &value) != nil {
+			continue
+		}
+		if t.Fields == nil {
+			t.Fields = map[string]float64{}
+		}
+		t.Fields[name] = value
+	}
+
+	return nil
+}
+
+// clusterInfo is the answer of the root endpoint, kafka_cluster_id is only
+// there since kafka connect 2.1.
+type clusterInfo struct {
+	Version        string `json:"version"`
+	Commit         string `json:"commit"`
+	KafkaClusterId string `json:"kafka_cluster_id"`
+}
+
+type plugin struct {
+	Class   string `json:"class"`
+	Type    string `json:"type"`
+	Version string `json:"version"`
+}
+
+type workerLoad struct {
+	connectors int
+	tasks      int
+}
+
+type workerLoads map[string]*workerLoad
+
+func (w workerLoads) get(workerId string) *workerLoad {
+	if w[workerId] == nil {
+		w[workerId] = &workerLoad{}
+	}
+	return w[workerId]
+}
+
+// taskImbalance is the difference between the most and the fewest tasks a
+// worker runs, 0 without workers.
+func (w workerLoads) taskImbalance() int {
+	first := true
+	var most, fewest int
+	for _, load := range w {
+		if first || load.tasks > most {
+			most = load.tasks
+		}
+		if first || load.tasks < fewest {
+			fewest = load.tasks
+		}
+		first = false
+	}
+	return most - fewest
+}
+
+// connectorHistory is what the exporter remembers about a connector between
+// scrapes.
+type connectorHistory struct {
+	state       string
+	transitions map[string]bool
+	lastRestart time.Time
+	pausedSince time.Time
+	changedAt   time.Time
+	restarting  int
+}
+
+type Options struct {
+	Username        string
+	Password        string
+	PasswordFile    string
+	BearerToken     string
+	BearerTokenFile string
+	TLSConfig       *tls.Config
+	ProxyURL        *url.URL
+	NoCompression   bool
+	HTTP2           bool
+	Headers         map[string]string
+	UserAgent       string
+	Timeout         time.Duration
+	DialTimeout     time.Duration
+	TLSTimeout      time.Duration
+	HeaderTimeout   time.Duration
+	RequestTimeout  time.Duration
+	Namespace       string
+	MaxConcurrency  int
+	RateLimit       float64
+	UseExpand       bool
+	MaxTraceLength  int
+	MaxTopics       int
+	MaxResponse     int64
+	MinConnectors   int
+	CollectPlugins  bool
+	CollectTopics   bool
+	CollectConfig   bool
+	Retries         int
+	Include         *regexp.Regexp
+	Exclude         *regexp.Regexp
+	NoTaskMetrics   bool
+	Minimal         bool
+	CacheTTL        time.Duration
+	ConstLabels     map[string]string
+	AutoRestart     bool
+	RestartCooldown time.Duration
+	Managed         bool
+	NoWorkerLabel   bool
+	TaskStateCodes  map[string]float64
 }
 
 type Exporter struct {
-	URI             string
-	up              prometheus.Gauge
-	connectorsCount prometheus.Gauge
+	URI                      string
+	opts                     Options
+	client                   ConnectClient
+	lastUp                   int32
+	cacheMu                  sync.Mutex
+	cached                   []prometheus.Metric
+	cachedAt                 time.Time
+	debugMu                  sync.Mutex
+	lastStatuses             []status
+	lastStatusesAt           time.Time
+	historyMu                sync.Mutex
+	history                  map[string]*connectorHistory
+	listed                   map[string]bool
+	up                       prometheus.Gauge
+	connectorsCount          *prometheus.Desc
+	belowMinimum             prometheus.Counter
+	clusterInfo              *prometheus.Desc
+	scrapeDuration           prometheus.Gauge
+	scrapeErrors             prometheus.Counter
+	scrapeRequests           prometheus.Counter
+	expandEnabled            prometheus.Gauge
+	lastScrapeSuccess        prometheus.Gauge
+	requestDuration          *prometheus.HistogramVec
+	isConnectorRunning       *prometheus.Desc
+	connectorStateInfo       *prometheus.Desc
+	areConnectorTasksRunning *prometheus.Desc
+	connectorTasksTotal      *prometheus.Desc
+	connectorTasksCount      *prometheus.Desc
+	taskFailedInfo           *prometheus.Desc
+	connectorFailedInfo      *prometheus.Desc
+	taskState                *prometheus.Desc
+	taskField                *prometheus.Desc
+	clusterTasks             map[string]*prometheus.Desc
+	connectorsState          *prometheus.Desc
+	anyFailed                *prometheus.Desc
+	rebalancing              *prometheus.Desc
+	workerSpread             *prometheus.Desc
+	connectorPresent         *prometheus.Desc
+	connectorPaused          *prometheus.Desc
+	connectorRestarting      *prometheus.Desc
+	stateChanged             *prometheus.Desc
+	workersCount             *prometheus.Desc
+	taskImbalance            *prometheus.Desc
+	workerConnectors         *prometheus.Desc
+	workerTasks              *prometheus.Desc
+	pluginsCount             *prometheus.Desc
+	pluginInfo               *prometheus.Desc
+	connectorTopicsCount     *prometheus.Desc
+	connectorTopic           *prometheus.Desc
+	connectorTasksMax        *prometheus.Desc
+	connectorInfo            *prometheus.Desc
+	connectorConfigHash      *prometheus.Desc
+	connectorScrapeStatus    *prometheus.Desc
+	stateTransitions         *prometheus.CounterVec
+	restartsIssued           *prometheus.CounterVec
+	connectorScrapeErrors    *prometheus.CounterVec
 }
 
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	e.up.Describe(ch)
+	ch <- e.connectorsCount
+	e.belowMinimum.Describe(ch)
+	ch <- e.connectorsState
+	ch <- e.anyFailed
+	ch <- e.rebalancing
+	ch <- e.workerSpread
+	ch <- e.connectorPresent
+	ch <- e.connectorPaused
+	ch <- e.connectorRestarting
+	ch <- e.stateChanged
+	ch <- e.clusterInfo
+	e.scrapeDuration.Describe(ch)
+	e.scrapeErrors.Describe(ch)
+	e.scrapeRequests.Describe(ch)
+	e.expandEnabled.Describe(ch)
+	e.lastScrapeSuccess.Describe(ch)
+	e.requestDuration.Describe(ch)
+	e.stateTransitions.Describe(ch)
+	e.restartsIssued.Describe(ch)
+	e.connectorScrapeErrors.Describe(ch)
+
+	ch <- e.isConnectorRunning
+	ch <- e.connectorStateInfo
+	ch <- e.areConnectorTasksRunning
+	ch <- e.connectorTasksTotal
+	ch <- e.connectorTasksCount
+	ch <- e.taskFailedInfo
+	ch <- e.connectorFailedInfo
+	ch <- e.taskState
+	ch <- e.taskField
+	for _, desc := range e.clusterTasks {
+		ch <- desc
+	}
+	ch <- e.workersCount
+	ch <- e.taskImbalance
+	ch <- e.workerConnectors
+	ch <- e.workerTasks
+	ch <- e.pluginsCount
+	ch <- e.pluginInfo
+	ch <- e.connectorTopicsCount
+	ch <- e.connectorTopic
+	ch <- e.connectorTasksMax
+	ch <- e.connectorInfo
+	ch <- e.connectorConfigHash
+	ch <- e.connectorScrapeStatus
 }
 
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+// parallel calls fn for every index below n using at most MaxConcurrency
+// goroutines and returns once all calls are done.
+func (e *Exporter) parallel(n int, fn func(i int)) {
+	indexes := make(chan int)
 
-	client := http.Client{
-		Timeout: 3 * time.Second,
+	workers := e.opts.MaxConcurrency
+	if workers > n {
+		workers = n
 	}
-	e.up.Set(0)
 
-	response, err := client.Get(e.URI + "/connectors")
-	if err != nil {
-		log.Errorf("Can't scrape kafka connect: %v", err)
-		ch <- e.up
-		return
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
 	}
-	defer func() {
-		err = response.Body.Close()
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// fetchStatuses gets the status of every connector in parallel. Connectors
+// whose status can't be fetched are logged and left out, without counting
+// an error once parent is done and the caller gave up on the scrape. codes
+// holds the HTTP status of every /status call that got an answer.
+func (e *Exporter) fetchStatuses(parent, ctx context.Context, connectorsList connectors) (statuses []status, codes map[string]int) {
+	results := make([]*status, len(connectorsList))
+	responses := make([]int, len(connectorsList))
+	e.parallel(len(connectorsList), func(i int) {
+		requestCtx, cancel := e.connectorContext(ctx)
+		defer cancel()
+		start := time.Now()
+		connectorStatus, err := e.client.ConnectorStatus(requestCtx, connectorsList[i])
+		e.observe("status", start)
 		if err != nil {
-			log.Errorf("Can't close connection to kafka connect: %v", err)
-			ch <- e.up
+			responses[i] = responseCode(err)
+			if parent.Err() != nil {
+				return
+			}
+			log.Errorf("Can't get status of connector %s: %v", connectorsList[i], err)
+			e.connectorScrapeErrors.WithLabelValues(connectorsList[i]).Inc()
 			return
 		}
-	}()
+		responses[i] = http.StatusOK
+		results[i] = connectorStatus
+	})
 
-	output, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		log.Errorf("Can't scrape kafka connect: %v", err)
-		ch <- e.up
-		return
+	codes = make(map[string]int, len(connectorsList))
+	for i, code := range responses {
+		if code != 0 {
+			codes[connectorsList[i]] = code
+		}
 	}
 
-	var connectorsList connectors
-	if err := json.Unmarshal(output, &connectorsList); err != nil {
-		log.Errorf("Can't scrape kafka connect: %v", err)
-		ch <- e.up
-		return
+	statuses = make([]status, 0, len(results))
+	for _, connectorStatus := range results {
+		if connectorStatus != nil {
+			statuses = append(statuses, *connectorStatus)
+		}
 	}
 
-	e.up.Set(1)
-	e.connectorsCount.Set(float64(len(connectorsList)))
+	return statuses, codes
+}
 
-	ch <- e.up
-	ch <- e.connectorsCount
+func (e *Exporter) collectTopics(ctx context.Context, ch chan<- prometheus.Metric, statuses []status) {
+	results := make([][]string, len(statuses))
+	e.parallel(len(statuses), func(i int) {
+		name := statuses[i].Name
+		requestCtx, cancel := e.connectorContext(ctx)
+		defer cancel()
+		start := time.Now()
+		topics, ok, err := e.client.ConnectorTopics(requestCtx, name)
+		e.observe("topics", start)
+		if err != nil {
+			log.Errorf("Can't get topics of connector %s: %v", name, err)
+			return
+		}
+		if !ok {
+			log.Debugf("Topics endpoint not supported, skipping topics of connector %s", name)
+			return
+		}
+		if topics == nil {
+			topics = []string{}
+		}
+		results[i] = topics
+	})
+
+	for i, topics := range results {
+		if topics == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(e.connectorTopicsCount, prometheus.GaugeValue, float64(len(topics)), statuses[i].Name)
+
+		sort.Strings(topics)
+		if e.opts.MaxTopics > 0 && len(topics) > e.opts.MaxTopics {
+			log.Debugf("Connector %s has %d topics, only exporting the first %d", statuses[i].Name, len(topics), e.opts.MaxTopics)
+			topics = topics[:e.opts.MaxTopics]
+		}
+		for _, topic := range topics {
+			ch <- prometheus.MustNewConstMetric(e.connectorTopic, prometheus.GaugeValue, 1, statuses[i].Name, topic)
+		}
+	}
+}
+
+func connectorType(connectorStatus status) string {
+	if connectorStatus.Type == "" {
+		return "unknown"
+	}
+	return strings.ToLower(connectorStatus.Type)
+}
+
+// tasksMax returns the tasks.max of a connector config, which defaults to 1
+// when it isn't set.
+func tasksMax(config map[string]string) (int, error) {
+	value, ok := config["tasks.max"]
+	if !ok {
+		return 1, nil
+	}
+	return strconv.Atoi(strings.TrimSpace(value))
+}
 
-	for _, connector := range connectorsList {
+// configHash is a hash of the config that doesn't depend on the order of its
+// keys. It has 32 bits so a float64 holds it exactly.
+func configHash(config map[string]string) uint32 {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := fnv.New32a()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%s\x00", key, config[key])
+	}
+	return hash.Sum32()
+}
 
-		connectorStatusResponse, err := client.Get(e.URI + "/connectors/" + connector + "/status")
+func (e *Exporter) collectConfigs(ctx context.Context, ch chan<- prometheus.Metric, statuses []status) {
+	results := make([]map[string]string, len(statuses))
+	e.parallel(len(statuses), func(i int) {
+		if statuses[i].Config != nil {
+			results[i] = statuses[i].Config
+			return
+		}
+		requestCtx, cancel := e.connectorContext(ctx)
+		defer cancel()
+		start := time.Now()
+		config, err := e.client.ConnectorConfig(requestCtx, statuses[i].Name)
+		e.observe("config", start)
 		if err != nil {
-			log.Errorf("Can't get /status for: %v", err)
+			log.Errorf("Can't get config of connector %s: %v", statuses[i].Name, err)
+			return
+		}
+		results[i] = config
+	})
+
+	for i, config := range results {
+		if config == nil {
 			continue
 		}
+		ch <- prometheus.MustNewConstMetric(
+			e.connectorInfo, prometheus.GaugeValue, 1,
+			statuses[i].Name, config["connector.class"], connectorType(statuses[i]),
+		)
+		ch <- prometheus.MustNewConstMetric(e.connectorConfigHash, prometheus.GaugeValue, float64(configHash(config)), statuses[i].Name)
 
-		connectorStatusOutput, err := ioutil.ReadAll(connectorStatusResponse.Body)
+		max, err := tasksMax(config)
 		if err != nil {
-			log.Errorf("Can't read Body for: %v", err)
+			log.Warnf("Can't parse tasks.max of connector %s: %v", statuses[i].Name, err)
 			continue
 		}
+		ch <- prometheus.MustNewConstMetric(e.connectorTasksMax, prometheus.GaugeValue, float64(max), statuses[i].Name)
+	}
+}
+
+func (e *Exporter) collectClusterInfo(ctx context.Context, ch chan<- prometheus.Metric) {
+	start := time.Now()
+	info, err := e.client.ClusterInfo(ctx)
+	e.observe("root", start)
+	if err != nil {
+		log.Errorf("Can't get kafka connect version: %v", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.clusterInfo, prometheus.GaugeValue, 1, info.Version, info.Commit, info.KafkaClusterId)
+}
+
+func (e *Exporter) collectPlugins(ctx context.Context, ch chan<- prometheus.Metric) {
+	start := time.Now()
+	plugins, err := e.client.Plugins(ctx)
+	e.observe("plugins", start)
+	if err != nil {
+		log.Errorf("Can't get connector plugins: %v", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.pluginsCount, prometheus.GaugeValue, float64(len(plugins)))
+	for _, p := range plugins {
+		ch <- prometheus.MustNewConstMetric(e.pluginInfo, prometheus.GaugeValue, 1, p.Class, strings.ToLower(p.Type), p.Version)
+	}
+}
+
+// collectTaskState exports one series per known state for the task, set to 1
+// for the state the task is in and 0 otherwise, and the numeric fields of its
+// status.
+func (e *Exporter) collectTaskState(ch chan<- prometheus.Metric, connector string, connectorTask task) {
+	id := fmt.Sprintf("%d", int(connectorTask.Id))
+	current := strings.ToLower(connectorTask.State)
+
+	known := false
+	for _, taskState := range taskStates {
+		var value float64
+		if taskState == current {
+			value = 1
+			known = true
+		}
+		ch <- prometheus.MustNewConstMetric(e.taskState, prometheus.GaugeValue, value, connector, id, taskState)
+	}
+	if !known {
+		ch <- prometheus.MustNewConstMetric(e.taskState, prometheus.GaugeValue, 1, connector, id, current)
+	}
+
+	for field, value := range connectorTask.Fields {
+		ch <- prometheus.MustNewConstMetric(e.taskField, prometheus.GaugeValue, value, connector, id, field)
+	}
+}
+
+// trackStates compares the connector states with the previous scrape and
+// counts transitions. Connectors that are no longer listed are forgotten and
+// returned as removed.
+func (e *Exporter) trackStates(connectorsList connectors, statuses []status) (removed []string) {
+	e.historyMu.Lock()
+	defer e.historyMu.Unlock()
+
+	for _, connectorStatus := range statuses {
+		state := strings.ToLower(connectorStatus.Connector.State)
+
+		history, ok := e.history[connectorStatus.Name]
+		if !ok {
+			history = &connectorHistory{state: state, transitions: map[string]bool{}, changedAt: time.Now()}
+			e.history[connectorStatus.Name] = history
+		} else if history.state != state {
+			e.stateTransitions.WithLabelValues(connectorStatus.Name, state).Inc()
+			history.transitions[state] = true
+			history.state = state
+			history.changedAt = time.Now()
+		}
+
+		if state != "paused" {
+			history.pausedSince = time.Time{}
+		} else if history.pausedSince.IsZero() {
+			history.pausedSince = time.Now()
+		}
+
+		if isRestarting(connectorStatus) {
+			history.restarting++
+		} else {
+			history.restarting = 0
+		}
+	}
+
+	listed := make(map[string]bool, len(connectorsList))
+	for _, name := range connectorsList {
+		listed[name] = true
+	}
+	for name := range e.listed {
+		if !listed[name] {
+			removed = append(removed, name)
+			e.connectorScrapeErrors.DeleteLabelValues(name)
+		}
+	}
+	e.listed = listed
 
-		var connectorStatus status
-		if err := json.Unmarshal(connectorStatusOutput, &connectorStatus); err != nil {
-			log.Errorf("Can't decode response for: %v", err)
+	for name, history := range e.history {
+		if listed[name] {
 			continue
 		}
+		for state := range history.transitions {
+			e.stateTransitions.DeleteLabelValues(name, state)
+		}
+		e.restartsIssued.DeleteLabelValues(name)
+		delete(e.history, name)
+	}
 
-		var isRunning float64 = 0
-		if strings.ToLower(connectorStatus.Connector.State) == "running" {
-			isRunning = 1
+	return removed
+}
+
+// connectorContext limits a request about a single connector to
+// RequestTimeout, so one slow connector can't use up the whole scrape.
+func (e *Exporter) connectorContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if e.opts.RequestTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, e.opts.RequestTimeout)
+}
+
+// observe records how long a call to an endpoint of kafka connect took.
+func (e *Exporter) observe(endpoint string, start time.Time) {
+	e.requestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+}
+
+// selected reports whether connector passes the include and exclude filters.
+func (e *Exporter) selected(connector string) bool {
+	if e.opts.Include != nil && !e.opts.Include.MatchString(connector) {
+		return false
+	}
+	return e.opts.Exclude == nil || !e.opts.Exclude.MatchString(connector)
+}
+
+// workerSpread is the number of distinct workers the connector and its tasks
+// run on.
+func workerSpread(connectorStatus status) int {
+	workers := map[string]bool{}
+	if connectorStatus.Connector.WorkerId != "" {
+		workers[connectorStatus.Connector.WorkerId] = true
+	}
+	for _, connectorTask := range connectorStatus.Tasks {
+		if connectorTask.WorkerId != "" {
+			workers[connectorTask.WorkerId] = true
 		}
+	}
+	return len(workers)
+}
 
-		ch <- prometheus.MustNewConstMetric(
-			isConnectorRunning, prometheus.GaugeValue, isRunning,
-			connectorStatus.Name, strings.ToLower(connectorStatus.Connector.State), connectorStatus.Connector.WorkerId,
-		)
+// isRestarting reports whether the connector or any of its tasks is
+// restarting.
+func isRestarting(connectorStatus status) bool {
+	if strings.ToLower(connectorStatus.Connector.State) == "restarting" {
+		return true
+	}
+	for _, connectorTask := range connectorStatus.Tasks {
+		if strings.ToLower(connectorTask.State) == "restarting" {
+			return true
+		}
+	}
+	return false
+}
 
-		for _, connectorTask := range connectorStatus.Tasks {
+// collectHistory exports for how long connectors are paused, counted from the
+// first scrape that found them paused, for how many scrapes in a row they
+// have been restarting and when their state last changed.
+func (e *Exporter) collectHistory(ch chan<- prometheus.Metric) {
+	e.historyMu.Lock()
+	defer e.historyMu.Unlock()
+
+	for name, history := range e.history {
+		if !history.pausedSince.IsZero() {
+			ch <- prometheus.MustNewConstMetric(e.connectorPaused, prometheus.GaugeValue, time.Since(history.pausedSince).Seconds(), name)
+		}
+		ch <- prometheus.MustNewConstMetric(e.connectorRestarting, prometheus.GaugeValue, float64(history.restarting), name)
+		ch <- prometheus.MustNewConstMetric(e.stateChanged, prometheus.GaugeValue, float64(history.changedAt.UnixNano())/1e9, name)
+	}
+}
 
-			var state float64
-			switch taskState := strings.ToLower(connectorTask.State)
-			taskState {
-			case "running":
-			    state = 1
-			case "unassigned":
-			    state = 2
-			case "paused":
-			    state = 3
-			default:
-			    state = 0
+// restartFailed restarts failed connectors, or only their failed tasks when
+// the connector itself is running, at most once per cooldown per connector.
+func (e *Exporter) restartFailed(ctx context.Context, statuses []status) {
+	for _, connectorStatus := range statuses {
+		name := connectorStatus.Name
+		failedConnector := strings.ToLower(connectorStatus.Connector.State) == "failed"
+		var failedTasks []task
+		for _, connectorTask := range connectorStatus.Tasks {
+			if strings.ToLower(connectorTask.State) == "failed" {
+				failedTasks = append(failedTasks, connectorTask)
 			}
+		}
+		if !failedConnector && len(failedTasks) == 0 {
+			continue
+		}
 
-			ch <- prometheus.MustNewConstMetric(
-				areConnectorTasksRunning, prometheus.GaugeValue, state,
-				connectorStatus.Name, strings.ToLower(connectorTask.State), connectorTask.WorkerId, fmt.Sprintf("%d", int(connectorTask.Id)),
-			)
+		e.historyMu.Lock()
+		history := e.history[name]
+		due := history != nil && time.Since(history.lastRestart) >= e.opts.RestartCooldown
+		if due {
+			history.lastRestart = time.Now()
+		}
+		e.historyMu.Unlock()
+		if !due {
+			log.Debugf("Not restarting connector %s, it was restarted less than %v ago", name, e.opts.RestartCooldown)
+			continue
 		}
 
-		err = connectorStatusResponse.Body.Close()
+		var err error
+		start := time.Now()
+		if failedConnector {
+			log.Warnf("Restarting failed connector %s and its tasks", name)
+			err = e.client.RestartConnector(ctx, name)
+		} else {
+			for _, connectorTask := range failedTasks {
+				log.Warnf("Restarting failed task %d of connector %s", int(connectorTask.Id), name)
+				if err = e.client.RestartTask(ctx, name, int(connectorTask.Id)); err != nil {
+					break
+				}
+			}
+		}
+		e.observe("restart", start)
 		if err != nil {
-			log.Errorf("Can't close connection to connector: %v", err)
+			log.Errorf("Can't restart connector %s: %v", name, err)
+			continue
 		}
+		e.restartsIssued.WithLabelValues(name).Inc()
 	}
-
-	return
 }
 
-func NewExporter(uri string) *Exporter {
-	log.Infoln("Collecting data from:", uri)
+// Reload replaces the credentials and connector filters of the exporter,
+// waiting for a scrape in progress to finish. Secret files are read again
+// on the next scrape.
+func (e *Exporter) Reload(opts Options) {
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
 
-	return &Exporter{
-		URI: uri,
-		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: nameSpace,
-			Name:      "up",
-			Help:      "was the last scrape of kafka connect successful?",
-		}),
-		connectorsCount: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: nameSpace,
-			Subsystem: "connectors",
-			Name:      "count",
-			Help:      "number of deployed connectors",
-		}),
+	e.opts.Username, e.opts.Password, e.opts.PasswordFile = opts.Username, opts.Password, opts.PasswordFile
+	e.opts.BearerToken, e.opts.BearerTokenFile = opts.BearerToken, opts.BearerTokenFile
+	e.opts.Managed = opts.Managed
+	e.opts.Include, e.opts.Exclude = opts.Include, opts.Exclude
+	e.cached = nil
+	if client, ok := e.client.(*connectClient); ok {
+		client.setCredentials(opts)
 	}
+}
 
+// LastStatuses returns the connector statuses of the last successful scrape
+// and when they were fetched, the zero time before the first one.
+func (e *Exporter) LastStatuses() ([]status, time.Time) {
+	e.debugMu.Lock()
+	defer e.debugMu.Unlock()
+	return e.lastStatuses, e.lastStatusesAt
 }
 
-var supportedSchema = map[string]bool{
-	"http":  true,
-	"https": true,
+// Ready reports whether the most recent scrape of kafka connect succeeded.
+func (e *Exporter) Ready() bool {
+	return atomic.LoadInt32(&e.lastUp) == 1
 }
 
-func main() {
-	flag.Parse()
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(context.Background(), ch)
+}
 
-	if *showVersion {
-		fmt.Printf("kafka_connect_exporter\n url: %s\n version: %s\n", versionUrl, version)
-		os.Exit(2)
+// contextCollector collects an exporter within the context of the HTTP
+// request asking for the metrics, so an abandoned scrape stops talking to
+// kafka connect.
+type contextCollector struct {
+	ctx      context.Context
+	exporter *Exporter
+}
+
+func (c *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+func (c *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collect(c.ctx, ch)
+}
+
+// collect scrapes kafka connect, or with a cache TTL replays the metrics of
+// the previous scrape while they are fresh. Only one scrape runs at a time,
+// callers arriving while it is in flight wait for and reuse its result.
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	requested := time.Now()
+
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
+
+	fresh := e.cached != nil && (e.cachedAt.After(requested) || time.Since(e.cachedAt) < e.opts.CacheTTL)
+	if !fresh {
+		metrics := make(chan prometheus.Metric)
+		done := make(chan []prometheus.Metric)
+		go func() {
+			var collected []prometheus.Metric
+			for metric := range metrics {
+				collected = append(collected, metric)
+			}
+			done <- collected
+		}()
+		e.scrape(ctx, metrics)
+		close(metrics)
+
+		collected := <-done
+		if ctx.Err() != nil {
+			// The scrape was cut short by the caller going away, the
+			// result says nothing about kafka connect.
+			for _, metric := range collected {
+				ch <- metric
+			}
+			return
+		}
+		e.cached, e.cachedAt = collected, time.Now()
 	}
 
-	parseURI, err := url.Parse(*scrapeURI)
-	if err != nil {
-		log.Errorf("%v", err)
-		os.Exit(1)
+	for _, metric := range e.cached {
+		ch <- metric
 	}
-	if !supportedSchema[parseURI.Scheme] {
-		log.Error("schema not supported")
-		os.Exit(1)
+}
+
+func (e *Exporter) scrape(parent context.Context, ch chan<- prometheus.Metric) {
+
+	start := time.Now()
+	defer func() {
+		e.scrapeDuration.Set(time.Since(start).Seconds())
+		ch <- e.scrapeDuration
+		ch <- e.scrapeErrors
+		ch <- e.scrapeRequests
+		ch <- e.expandEnabled
+		ch <- e.belowMinimum
+		ch <- e.lastScrapeSuccess
+		e.requestDuration.Collect(ch)
+	}()
+
+	ctx, cancel := context.WithTimeout(parent, e.opts.Timeout)
+	defer cancel()
+	e.up.Set(0)
+
+	// connectors_count is only exported together with up=1, a failed scrape
+	// drops it rather than reporting a count that is out of date or zero.
+	var connectorsList connectors
+	var statuses []status
+	var codes map[string]int
+	expanded := false
+	if e.opts.UseExpand && !e.opts.Minimal {
+		var err error
+		requestStart := time.Now()
+		statuses, err = e.client.ExpandedStatuses(ctx)
+		e.observe("expand", requestStart)
+		if err != nil {
+			log.Warnf("Can't use the expand API, falling back to per connector requests: %v", err)
+		} else {
+			expanded = true
+			selected := statuses[:0]
+			for _, connectorStatus := range statuses {
+				if e.selected(connectorStatus.Name) {
+					selected = append(selected, connectorStatus)
+					connectorsList = append(connectorsList, connectorStatus.Name)
+				}
+			}
+			statuses = selected
+		}
 	}
 
-	log.Infoln("Starting kafka_connect_exporter")
+	if expanded {
+		e.expandEnabled.Set(1)
+	} else {
+		e.expandEnabled.Set(0)
+	}
 
-	prometheus.Unregister(prometheus.NewGoCollector())
-	prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
-	prometheus.MustRegister(NewExporter(*scrapeURI))
+	if !expanded {
+		var err error
+		requestStart := time.Now()
+		connectorsList, err = e.client.Connectors(ctx)
+		e.observe("connectors", requestStart)
+		if err != nil && parent.Err() != nil {
+			log.Debugf("Scrape of kafka connect abandoned by the caller: %v", err)
+			ch <- e.up
+			return
+		}
+		if err != nil {
+			log.Errorf("Can't scrape kafka connect: %v", err)
+			e.scrapeErrors.Inc()
+			atomic.StoreInt32(&e.lastUp, 0)
+			ch <- e.up
+			return
+		}
+		selected := connectorsList[:0]
+		for _, name := range connectorsList {
+			if e.selected(name) {
+				selected = append(selected, name)
+			}
+		}
+		connectorsList = selected
+		if !e.opts.Minimal {
+			statuses, codes = e.fetchStatuses(parent, ctx, connectorsList)
+		}
+	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, *metricsPath, http.StatusMovedPermanently)
-	})
+	if !e.opts.Minimal {
+		e.debugMu.Lock()
+		e.lastStatuses, e.lastStatusesAt = statuses, time.Now()
+		e.debugMu.Unlock()
+	}
 
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	e.up.Set(1)
+	atomic.StoreInt32(&e.lastUp, 1)
+
+	ch <- e.up
+	ch <- prometheus.MustNewConstMetric(e.connectorsCount, prometheus.GaugeValue, float64(len(connectorsList)))
+	if len(connectorsList) < e.opts.MinConnectors {
+		log.Warnf("Kafka connect %s lists %d connectors, expected at least %d", e.URI, len(connectorsList), e.opts.MinConnectors)
+		e.belowMinimum.Inc()
+	}
+	if e.opts.Minimal {
+		e.lastScrapeSuccess.SetToCurrentTime()
+		return
+	}
+	for name, code := range codes {
+		ch <- prometheus.MustNewConstMetric(e.connectorScrapeStatus, prometheus.GaugeValue, 1, name, strconv.Itoa(code))
+	}
+
+	// The base path of a managed cluster isn't the root of a connect worker,
+	// there is no version to get.
+	if !e.opts.Managed {
+		e.collectClusterInfo(ctx, ch)
+	}
+	for _, name := range e.trackStates(connectorsList, statuses) {
+		ch <- prometheus.MustNewConstMetric(e.connectorPresent, prometheus.GaugeValue, 0, name)
+	}
+	for _, name := range connectorsList {
+		ch <- prometheus.MustNewConstMetric(e.connectorPresent, prometheus.GaugeValue, 1, name)
+	}
+	e.stateTransitions.Collect(ch)
+	e.collectHistory(ch)
+	if e.opts.AutoRestart {
+		e.restartFailed(ctx, statuses)
+	}
+	e.restartsIssued.Collect(ch)
+	e.connectorScrapeErrors.Collect(ch)
+
+	if e.opts.CollectPlugins {
+		e.collectPlugins(ctx, ch)
+	}
+	if e.opts.CollectTopics {
+		e.collectTopics(ctx, ch, statuses)
+	}
+	if e.opts.CollectConfig {
+		e.collectConfigs(ctx, ch, statuses)
+	}
+
+	clusterTasksByState := make(map[string]int, len(taskStates))
+	connectorsByState := make(map[string]int, len(connectorStates))
+	rebalancing := 0
+	for _, connectorState := range connectorStates {
+		connectorsByState[connectorState] = 0
+	}
+	workers := workerLoads{}
+
+	for _, connectorStatus := range statuses {
+
+		var isRunning float64 = 0
+		if strings.ToLower(connectorStatus.Connector.State) == "running" {
+			isRunning = 1
+		}
+
+		if connectorStatus.Connector.WorkerId != "" {
+			workers.get(connectorStatus.Connector.WorkerId).connectors++
+		}
+		connectorsByState[strings.ToLower(connectorStatus.Connector.State)]++
+
+		ch <- prometheus.MustNewConstMetric(
+			e.isConnectorRunning, prometheus.GaugeValue, isRunning,
+			workerLabel(e.opts, []string{connectorStatus.Name, strings.ToLower(connectorStatus.Connector.State), connectorStatus.Connector.WorkerId, connectorType(connectorStatus)}, 2)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.connectorStateInfo, prometheus.GaugeValue, 1,
+			connectorStatus.Name, strings.ToLower(connectorStatus.Connector.State),
+		)
+
+		if strings.ToLower(connectorStatus.Connector.State) == "failed" {
+			ch <- prometheus.MustNewConstMetric(
+				e.connectorFailedInfo, prometheus.GaugeValue, 1,
+				connectorStatus.Name, truncate(connectorStatus.Connector.Trace, e.opts.MaxTraceLength),
+			)
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			e.connectorTasksCount, prometheus.GaugeValue, float64(len(connectorStatus.Tasks)),
+			connectorStatus.Name,
+		)
+
+		tasksByState := make(map[string]int, len(taskStates))
+		for _, taskState := range taskStates {
+			tasksByState[taskState] = 0
+		}
+
+		for _, connectorTask := range connectorStatus.Tasks {
+			tasksByState[strings.ToLower(connectorTask.State)]++
+			if connectorTask.WorkerId != "" {
+				workers.get(connectorTask.WorkerId).tasks++
+			}
+			if e.opts.NoTaskMetrics {
+				continue
+			}
+
+			state, ok := e.opts.TaskStateCodes[strings.ToLower(connectorTask.State)]
+			if !ok {
+				state = e.opts.TaskStateCodes["failed"]
+			}
+
+			ch <- prometheus.MustNewConstMetric(
+				e.areConnectorTasksRunning, prometheus.GaugeValue, state,
+				workerLabel(e.opts, []string{connectorStatus.Name, strings.ToLower(connectorTask.State), connectorTask.WorkerId, fmt.Sprintf("%d", int(connectorTask.Id))}, 2)...,
+			)
+
+			e.collectTaskState(ch, connectorStatus.Name, connectorTask)
+
+			if strings.ToLower(connectorTask.State) == "failed" {
+				ch <- prometheus.MustNewConstMetric(
+					e.taskFailedInfo, prometheus.GaugeValue, 1,
+					connectorStatus.Name, fmt.Sprintf("%d", int(connectorTask.Id)), truncate(connectorTask.Trace, e.opts.MaxTraceLength),
+				)
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.workerSpread, prometheus.GaugeValue, float64(workerSpread(connectorStatus)), connectorStatus.Name)
+
+		if strings.ToLower(connectorStatus.Connector.State) == "unassigned" || tasksByState["unassigned"] > 0 {
+			rebalancing++
+		}
+
+		for taskState, count := range tasksByState {
+			clusterTasksByState[taskState] += count
+			ch <- prometheus.MustNewConstMetric(
+				e.connectorTasksTotal, prometheus.GaugeValue, float64(count),
+				connectorStatus.Name, taskState,
+			)
+		}
+	}
+
+	for taskState, desc := range e.clusterTasks {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(clusterTasksByState[taskState]))
+	}
+	for connectorState, count := range connectorsByState {
+		ch <- prometheus.MustNewConstMetric(e.connectorsState, prometheus.GaugeValue, float64(count), connectorState)
+	}
+	var anyFailed float64
+	if connectorsByState["failed"]+clusterTasksByState["failed"] > 0 {
+		anyFailed = 1
+	}
+	ch <- prometheus.MustNewConstMetric(e.anyFailed, prometheus.GaugeValue, anyFailed)
+	ch <- prometheus.MustNewConstMetric(e.rebalancing, prometheus.GaugeValue, float64(rebalancing))
+
+	ch <- prometheus.MustNewConstMetric(e.workersCount, prometheus.GaugeValue, float64(len(workers)))
+	ch <- prometheus.MustNewConstMetric(e.taskImbalance, prometheus.GaugeValue, float64(workers.taskImbalance()))
+	for workerId, load := range workers {
+		if !e.opts.NoWorkerLabel {
+			ch <- prometheus.MustNewConstMetric(e.workerConnectors, prometheus.GaugeValue, float64(load.connectors), workerId)
+			ch <- prometheus.MustNewConstMetric(e.workerTasks, prometheus.GaugeValue, float64(load.tasks), workerId)
+		}
+	}
+
+	e.lastScrapeSuccess.SetToCurrentTime()
+	return
+}
+
+func NewExporter(uri *url.URL, cluster string, opts Options) *Exporter {
+	log.Infoln("Collecting data from:", redact(uri), "as cluster:", cluster)
+
+	client := newConnectClient(uri, opts)
+	exporter := NewExporterWithClient(client, cluster, opts)
+	exporter.URI = redact(uri)
+	client.requests = exporter.scrapeRequests
+	return exporter
+}
+
+// NewExporterWithClient returns an exporter that gets its data from client
+// instead of talking to kafka connect over HTTP itself.
+func NewExporterWithClient(client ConnectClient, cluster string, opts Options) *Exporter {
+	if opts.TaskStateCodes == nil {
+		opts.TaskStateCodes = taskStateCodes
+	}
+	constLabels := prometheus.Labels{"cluster": cluster}
+	for name, value := range opts.ConstLabels {
+		constLabels[name] = value
+	}
+
+	clusterTasks := make(map[string]*prometheus.Desc, len(taskStates))
+	for _, taskState := range taskStates {
+		clusterTasks[taskState] = prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "tasks", taskState+"_total"),
+			fmt.Sprintf("number of tasks in %s state across all connectors", taskState),
+			nil, constLabels)
+	}
+
+	return &Exporter{
+		opts:    opts,
+		client:  client,
+		history: map[string]*connectorHistory{},
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Name:        "up",
+			Help:        "was the last scrape of kafka connect successful?",
+			ConstLabels: constLabels,
+		}),
+		belowMinimum: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "connector",
+			Name:        "count_below_threshold_total",
+			Help:        "number of scrapes that found fewer connectors than min-connectors",
+			ConstLabels: constLabels,
+		}),
+		connectorsCount: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connectors", "count"),
+			"number of deployed connectors",
+			nil, constLabels),
+		connectorPresent: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "present"),
+			"1 while the connector is deployed, 0 for one scrape after it was removed",
+			[]string{"connector"}, constLabels),
+		connectorPaused: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "paused_seconds"),
+			"how long the connector has been paused, only exported while it is",
+			[]string{"connector"}, constLabels),
+		stateChanged: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "state_changed_timestamp_seconds"),
+			"unix time the connector state last changed, or the exporter first saw the connector",
+			[]string{"connector"}, constLabels),
+		connectorRestarting: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "restarting_scrapes"),
+			"number of consecutive scrapes that found the connector or one of its tasks restarting",
+			[]string{"connector"}, constLabels),
+		connectorsState: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connectors", "state_total"),
+			"number of connectors in each state",
+			[]string{"state"}, constLabels),
+		anyFailed: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "", "any_connector_failed"),
+			"1 if any connector or task is failed, 0 otherwise",
+			nil, constLabels),
+		workerSpread: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "worker_spread"),
+			"number of distinct workers the connector and its tasks run on",
+			[]string{"connector"}, constLabels),
+		rebalancing: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connectors", "rebalancing"),
+			"number of connectors that are unassigned or have unassigned tasks",
+			nil, constLabels),
+		clusterInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "cluster", "info"),
+			"version of kafka connect and id of the kafka cluster it uses, always 1",
+			[]string{"version", "commit", "kafka_cluster_id"}, constLabels),
+		scrapeDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "scrape",
+			Name:        "duration_seconds",
+			Help:        "how long the last scrape of kafka connect took",
+			ConstLabels: constLabels,
+		}),
+		scrapeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "scrape",
+			Name:        "errors_total",
+			Help:        "number of failed scrapes of kafka connect",
+			ConstLabels: constLabels,
+		}),
+		expandEnabled: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "scrape",
+			Name:        "expand_enabled",
+			Help:        "1 if the last scrape used the expand API, 0 if it requested every connector on its own",
+			ConstLabels: constLabels,
+		}),
+		scrapeRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "scrape",
+			Name:        "requests_total",
+			Help:        "number of HTTP requests sent to kafka connect, retries included",
+			ConstLabels: constLabels,
+		}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "scrape",
+			Name:        "request_duration_seconds",
+			Help:        "how long the requests to kafka connect took, by endpoint",
+			ConstLabels: constLabels,
+		}, []string{"endpoint"}),
+		lastScrapeSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Name:        "last_scrape_success_timestamp_seconds",
+			Help:        "unix time of the last successful scrape of kafka connect",
+			ConstLabels: constLabels,
+		}),
+		stateTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "connector",
+			Name:        "state_transitions_total",
+			Help:        "number of observed changes of the connector state, by new state",
+			ConstLabels: constLabels,
+		}, []string{"connector", "to_state"}),
+		connectorScrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "connector",
+			Name:        "scrape_errors_total",
+			Help:        "number of failed status requests for the connector",
+			ConstLabels: constLabels,
+		}, []string{"connector"}),
+		restartsIssued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   "connector",
+			Name:        "restarts_issued_total",
+			Help:        "number of restarts of failed connectors or tasks issued by the exporter",
+			ConstLabels: constLabels,
+		}, []string{"connector"}),
+		isConnectorRunning: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "state_running"),
+			"is the connector running?",
+			workerLabel(opts, []string{"connector", "state", "worker", "type"}, 2), constLabels),
+		connectorStateInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "state_info"),
+			"state of the connector as reported by kafka connect, always 1",
+			[]string{"connector", "state"}, constLabels),
+		areConnectorTasksRunning: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "tasks_state"),
+			"the state of tasks. "+taskStateHelp(opts.TaskStateCodes)+", other states as failed",
+			workerLabel(opts, []string{"connector", "state", "worker_id", "id"}, 2), constLabels),
+		connectorTasksTotal: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "tasks_total"),
+			"number of tasks of the connector in each state",
+			[]string{"connector", "state"}, constLabels),
+		connectorTasksCount: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "tasks_count"),
+			"number of tasks of the connector",
+			[]string{"connector"}, constLabels),
+		taskState: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "task_state"),
+			"whether the task is in the given state, one series per state",
+			[]string{"connector", "id", "state"}, constLabels),
+		taskField: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "task_field"),
+			"value of a numeric field of the task status other than id, by field name",
+			[]string{"connector", "id", "field"}, constLabels),
+		taskFailedInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "task_failed_info"),
+			"failure trace of a failed task, always 1",
+			[]string{"connector", "id", "trace"}, constLabels),
+		connectorFailedInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "failed_info"),
+			"failure trace of a failed connector, always 1",
+			[]string{"connector", "trace"}, constLabels),
+		clusterTasks: clusterTasks,
+		workersCount: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "workers", "count"),
+			"number of distinct workers running connectors or tasks",
+			nil, constLabels),
+		taskImbalance: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "worker", "task_imbalance"),
+			"difference between the most and the fewest tasks running on a worker",
+			nil, constLabels),
+		workerConnectors: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "worker", "connectors"),
+			"number of connectors running on the worker",
+			[]string{"worker_id"}, constLabels),
+		workerTasks: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "worker", "tasks"),
+			"number of tasks running on the worker",
+			[]string{"worker_id"}, constLabels),
+		pluginsCount: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "plugins", "count"),
+			"number of installed connector plugins",
+			nil, constLabels),
+		pluginInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "plugin", "info"),
+			"installed connector plugin, always 1",
+			[]string{"class", "type", "version"}, constLabels),
+		connectorTopicsCount: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "topics_count"),
+			"number of active topics of the connector",
+			[]string{"connector"}, constLabels),
+		connectorTopic: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "topic"),
+			"active topic of the connector, always 1",
+			[]string{"connector", "topic"}, constLabels),
+		connectorScrapeStatus: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "scrape_status"),
+			"HTTP status of the last status request for the connector, always 1",
+			[]string{"connector", "code"}, constLabels),
+		connectorInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "info"),
+			"class and type of the connector, always 1",
+			[]string{"connector", "class", "type"}, constLabels),
+		connectorConfigHash: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "config_hash"),
+			"hash of the connector config, changes whenever the config does",
+			[]string{"connector"}, constLabels),
+		connectorTasksMax: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "connector", "tasks_max"),
+			"configured maximum number of tasks of the connector",
+			[]string{"connector"}, constLabels),
+	}
+
+}
+
+// redact hides the password of a URI so it can be logged and shown.
+func redact(uri *url.URL) string {
+	if uri.User == nil {
+		return uri.String()
+	}
+	if _, ok := uri.User.Password(); !ok {
+		return uri.String()
+	}
+
+	redacted := *uri
+	redacted.User = url.UserPassword(uri.User.Username(), "xxxxx")
+	return redacted.String()
+}
+
+// truncate shortens s to at most max characters, a max of 0 leaves s untouched.
+func truncate(s string, max int) string {
+	if max <= 0 {
+		return s
+	}
+
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+
+	return string(runes[:max])
+}
+
+func setupLogging(level, format string) error {
+	switch level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unsupported log.level %q", level)
+	}
+	if err := log.Base().SetLevel(level); err != nil {
+		return err
+	}
+
+	switch format {
+	case "logfmt":
+		return log.Base().SetFormat("logger:stderr")
+	case "json":
+		return log.Base().SetFormat("logger:stderr?json=true")
+	default:
+		return fmt.Errorf("unsupported log.format %q", format)
+	}
+}
+
+func newBuildInfo(namespace string, constLabels map[string]string) prometheus.Collector {
+	labels := prometheus.Labels{}
+	for name, value := range constLabels {
+		labels[name] = value
+	}
+	labels["version"] = version
+	labels["revision"] = revision
+	labels["goversion"] = runtime.Version()
+
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "exporter",
+		Name:        "build_info",
+		Help:        "build information of kafka_connect_exporter, always 1",
+		ConstLabels: labels,
+	}, func() float64 { return 1 })
+}
+
+// newStartTime exports when the exporter started, standing in for the
+// process_start_time_seconds of the unregistered process collector.
+func newStartTime(namespace string, constLabels map[string]string) prometheus.Collector {
+	startTimeGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "exporter",
+		Name:        "start_time_seconds",
+		Help:        "unix time the exporter started at",
+		ConstLabels: constLabels,
+	})
+	startTimeGauge.Set(float64(startTime.UnixNano()) / 1e9)
+	return startTimeGauge
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read CA bundle: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+	}
+
+	return pool, nil
+}
+
+func newTLSConfig(certFile, keyFile, caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("scrape-tls-cert and scrape-tls-key must be set together")
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+func parseConstLabels(specs []string) (map[string]string, error) {
+	labels := make(map[string]string, len(specs))
+
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || !labelNameRE.MatchString(parts[0]) || strings.HasPrefix(parts[0], "__") {
+			return nil, fmt.Errorf("malformed const-label %q, expected \"name=value\" with a valid label name", spec)
+		}
+		if parts[0] == "cluster" {
+			return nil, fmt.Errorf("const-label can't set cluster, use cluster-name instead")
+		}
+		labels[parts[0]] = parts[1]
+	}
+
+	return labels, nil
+}
+
+// workerLabel returns labels without the worker label at index i when
+// NoWorkerLabel is set, it works on label names and values alike.
+func workerLabel(opts Options, labels []string, i int) []string {
+	if !opts.NoWorkerLabel {
+		return labels
+	}
+	return append(labels[:i:i], labels[i+1:]...)
+}
+
+// parseTaskStateMapping returns the tasks_state codes with the "state=code"
+// overrides of specs applied, each spec may hold several comma separated.
+func parseTaskStateMapping(specs []string) (map[string]float64, error) {
+	codes := make(map[string]float64, len(taskStateCodes))
+	for state, code := range taskStateCodes {
+		codes[state] = code
+	}
+
+	for _, spec := range specs {
+		for _, pair := range strings.Split(spec, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("malformed task-state-mapping %q, expected \"state=code\"", pair)
+			}
+			state := strings.ToLower(strings.TrimSpace(parts[0]))
+			if _, ok := taskStateCodes[state]; !ok {
+				return nil, fmt.Errorf("unknown task state %q in task-state-mapping", parts[0])
+			}
+			code, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid code %q for %s in task-state-mapping", parts[1], state)
+			}
+			codes[state] = code
+		}
+	}
+
+	seen := make(map[float64]string, len(codes))
+	for _, state := range taskStates {
+		if other, ok := seen[codes[state]]; ok {
+			return nil, fmt.Errorf("task-state-mapping gives %s and %s the same code", other, state)
+		}
+		seen[codes[state]] = state
+	}
+
+	return codes, nil
+}
+
+// taskStateHelp describes the codes as "0-failed, 1-running, ...".
+func taskStateHelp(codes map[string]float64) string {
+	states := make([]string, 0, len(codes))
+	for state := range codes {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return codes[states[i]] < codes[states[j]]
+	})
+
+	parts := make([]string, 0, len(states))
+	for _, state := range states {
+		parts = append(parts, strconv.FormatFloat(codes[state], 'f', -1, 64)+"-"+state)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func parseHeaders(specs []string) (map[string]string, error) {
+	headers := make(map[string]string, len(specs))
+
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("malformed scrape-header %q, expected \"Name: Value\"", spec)
+		}
+		headers[name] = strings.TrimSpace(parts[1])
+	}
+
+	return headers, nil
+}
+
+func envName(flagName string) string {
+	return "KAFKA_CONNECT_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+func applyEnv(flags *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "version" {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, envName(f.Name), setErr)
+			}
+		}
+	})
+
+	return err
+}
+
+var namespaceRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var supportedSchema = map[string]bool{
+	"http":  true,
+	"https": true,
+	"unix":  true,
+}
+
+var supportedProxySchema = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"socks5": true,
+}
+
+func main() {
+	flag.Var(&metricsPaths, "telemetry-path", "Path under which to expose metrics, repeat to serve them under several paths. (default \"/metrics\")")
+	flag.Var(&scrapeURIs, "scrape-uri", "URI on which to scrape kafka connect, repeat to scrape several clusters. (default \"http://127.0.0.1:8080\")")
+	flag.Var(&clusterNames, "cluster-name", "Value of the cluster label, repeat once per scrape-uri in the same order. (default: host of the scrape-uri)")
+	flag.Var(&constLabelSpecs, "const-label", "Label to add to every metric, as \"name=value\" (repeatable).")
+	flag.Var(&taskStateMapping, "task-state-mapping", "Value of tasks_state for a task state, as \"state=code\" (repeatable), other states keep their default.")
+	flag.Var(&scrapeHeaders, "scrape-header", "Header to send with every request to kafka connect, as \"Name: Value\" (repeatable).")
+	flag.Parse()
+
+	if err := applyEnv(flag.CommandLine); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	// Flags set so far win over the config file, also when it is reloaded.
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if *configFile != "" {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		if err := applyConfig(flag.CommandLine, cfg); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	if *showVersion {
+		fmt.Printf("kafka_connect_exporter\n url: %s\n version: %s\n revision: %s\n", versionUrl, version, revision)
+		os.Exit(2)
+	}
+
+	if (*webAuthUsername == "") != (*webAuthPassword == "") {
+		log.Error("web.auth-username and web.auth-password must be set together")
+		os.Exit(1)
+	}
+
+	tlsConfig, err := newTLSConfig(*scrapeTLSCert, *scrapeTLSKey, *scrapeTLSCA, *scrapeTLSInsecure)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if *scrapeTLSInsecure {
+		log.Warn("TLS certificate verification of kafka connect is disabled")
+	}
+
+	if *scrapeTimeout <= 0 {
+		log.Error("scrape-timeout must be positive")
+		os.Exit(1)
+	}
+
+	if *scrapeDialTimeout < 0 || *scrapeTLSTimeout < 0 || *scrapeHeaderTimeout < 0 {
+		log.Error("scrape-dial-timeout, scrape-tls-handshake-timeout and scrape-response-header-timeout can't be negative")
+		os.Exit(1)
+	}
+
+	if *connectorTimeout < 0 {
+		log.Error("connector-timeout can't be negative")
+		os.Exit(1)
+	}
+
+	if *maxTraceLength < 0 {
+		log.Error("max-trace-length can't be negative")
+		os.Exit(1)
+	}
+
+	if *minConnectors < 0 {
+		log.Error("min-connectors can't be negative")
+		os.Exit(1)
+	}
+
+	if *maxResponseBytes < 0 {
+		log.Error("max-response-bytes can't be negative")
+		os.Exit(1)
+	}
+
+	if *maxTopics < 0 {
+		log.Error("max-topics-per-connector can't be negative")
+		os.Exit(1)
+	}
+
+	if *scrapeRetries < 0 {
+		log.Error("scrape-retries can't be negative")
+		os.Exit(1)
+	}
+
+	if *autoRestartFailed {
+		log.Warnf("Failed connectors and tasks will be restarted, at most once every %v per connector", *autoRestartCooldown)
+	}
+
+	if *cacheTTL < 0 {
+		log.Error("cache-ttl can't be negative")
+		os.Exit(1)
+	}
+
+	if *maxConcurrency < 1 {
+		log.Error("max-concurrency must be at least 1")
+		os.Exit(1)
+	}
+
+	if *probeMaxTargets < 1 {
+		log.Error("probe-max-targets must be at least 1")
+		os.Exit(1)
+	}
+
+	if *scrapeRateLimit < 0 {
+		log.Error("scrape-rate-limit can't be negative")
+		os.Exit(1)
+	}
+
+	if !namespaceRE.MatchString(*metricNamespace) {
+		log.Errorf("invalid metric-namespace %q, must match %s", *metricNamespace, namespaceRE)
+		os.Exit(1)
+	}
+
+	userAgent := *scrapeUserAgent
+	if userAgent == "" {
+		userAgent = "kafka_connect_exporter/" + version
+	}
+
+	var proxyURL *url.URL
+	if *scrapeProxyURL != "" {
+		if proxyURL, err = url.Parse(*scrapeProxyURL); err != nil {
+			log.Errorf("invalid scrape-proxy-url: %v", err)
+			os.Exit(1)
+		}
+		if !supportedProxySchema[proxyURL.Scheme] {
+			log.Errorf("proxy schema not supported: %s", redact(proxyURL))
+			os.Exit(1)
+		}
+	}
+
+	headers, err := parseHeaders(scrapeHeaders)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	constLabels, err := parseConstLabels(constLabelSpecs)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	stateCodes, err := parseTaskStateMapping(taskStateMapping)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	if len(metricsPaths) == 0 {
+		metricsPaths = stringSlice{"/metrics"}
+	}
+	// The metrics can't take over a path another handler is registered on,
+	// only / is given up in favour of the metrics.
+	seenPaths := map[string]bool{"/healthz": true, "/ready": true}
+	if *probeEnabled {
+		seenPaths["/probe"] = true
+	}
+	if *debugEndpoints {
+		seenPaths["/debug/connectors"] = true
+	}
+	for _, path := range metricsPaths {
+		if !strings.HasPrefix(path, "/") {
+			log.Errorf("telemetry-path %q must start with /", path)
+			os.Exit(1)
+		}
+		if seenPaths[path] {
+			log.Errorf("telemetry-path %q is configured more than once or used by another handler", path)
+			os.Exit(1)
+		}
+		seenPaths[path] = true
+	}
+	metricsPath := metricsPaths[0]
+
+	if len(scrapeURIs) == 0 {
+		scrapeURIs = stringSlice{"http://127.0.0.1:8080"}
+	}
+	if len(clusterNames) != 0 && len(clusterNames) != len(scrapeURIs) {
+		log.Errorf("got %d cluster-name values for %d scrape-uri values", len(clusterNames), len(scrapeURIs))
+		os.Exit(1)
+	}
+
+	// Exporters are built in the order of the scrape-uri flags, the map only
+	// catches duplicate cluster names.
+	type scrapeTarget struct {
+		cluster string
+		uri     *url.URL
+	}
+	targets := make([]scrapeTarget, 0, len(scrapeURIs))
+	clusters := make(map[string]bool, len(scrapeURIs))
+	for i, uri := range scrapeURIs {
+		parseURI, err := url.Parse(uri)
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		if !supportedSchema[parseURI.Scheme] {
+			log.Errorf("schema not supported: %s", uri)
+			os.Exit(1)
+		}
+		if parseURI.Scheme == "unix" && (parseURI.Host != "" || parseURI.Path == "") {
+			log.Errorf("malformed unix socket uri %s, expected unix:///path/to/socket", uri)
+			os.Exit(1)
+		}
+
+		cluster := parseURI.Host
+		if parseURI.Scheme == "unix" {
+			cluster = parseURI.Path
+		}
+		if len(clusterNames) != 0 {
+			cluster = clusterNames[i]
+		}
+		if clusters[cluster] {
+			log.Errorf("cluster %q is configured more than once", cluster)
+			os.Exit(1)
+		}
+		clusters[cluster] = true
+		targets = append(targets, scrapeTarget{cluster: cluster, uri: parseURI})
+	}
+
+	log.Infoln("Starting kafka_connect_exporter")
+
+	if !*runtimeMetrics {
+		prometheus.Unregister(prometheus.NewGoCollector())
+		prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	}
+	opts := Options{
+		TLSConfig:       tlsConfig,
+		ProxyURL:        proxyURL,
+		NoCompression:   !*scrapeGzip,
+		HTTP2:           *scrapeHTTP2,
+		Headers:         headers,
+		UserAgent:       userAgent,
+		Timeout:         *scrapeTimeout,
+		DialTimeout:     *scrapeDialTimeout,
+		TLSTimeout:      *scrapeTLSTimeout,
+		HeaderTimeout:   *scrapeHeaderTimeout,
+		RequestTimeout:  *connectorTimeout,
+		Namespace:       *metricNamespace,
+		MaxConcurrency:  *maxConcurrency,
+		RateLimit:       *scrapeRateLimit,
+		UseExpand:       *useExpand,
+		MaxTraceLength:  *maxTraceLength,
+		MaxTopics:       *maxTopics,
+		MaxResponse:     *maxResponseBytes,
+		MinConnectors:   *minConnectors,
+		CollectPlugins:  *collectPlugins,
+		CollectTopics:   *collectTopics,
+		CollectConfig:   *collectConfig,
+		Retries:         *scrapeRetries,
+		NoTaskMetrics:   *disableTaskMetrics,
+		Minimal:         *minimal,
+		CacheTTL:        *cacheTTL,
+		ConstLabels:     constLabels,
+		AutoRestart:     *autoRestartFailed,
+		RestartCooldown: *autoRestartCooldown,
+		TaskStateCodes:  stateCodes,
+		NoWorkerLabel:   *dropWorkerLabel,
+	}
+	opts, err = dynamicOptions(opts, func(name string) string {
+		return flag.Lookup(name).Value.String()
+	})
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if err := prometheus.Register(newBuildInfo(*metricNamespace, constLabels)); err != nil {
+		log.Errorf("invalid const-label: %v", err)
+		os.Exit(1)
+	}
+	prometheus.MustRegister(newStartTime(*metricNamespace, constLabels))
+	exporters := make([]*Exporter, 0, len(targets))
+	for _, target := range targets {
+		exporter := NewExporter(target.uri, target.cluster, opts)
+		// Exporters are registered per request, registering them once here
+		// catches const labels that clash with the labels of a metric.
+		if err := prometheus.NewRegistry().Register(exporter); err != nil {
+			log.Errorf("invalid const-label: %v", err)
+			os.Exit(1)
+		}
+		exporters = append(exporters, exporter)
+	}
+
+	if *checkOnly {
+		if !check(os.Stdout, exporters) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	metricsHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, exportersHandler(prometheus.DefaultGatherer, exporters...))
+	if *webAuthUsername != "" {
+		metricsHandler = basicAuth(*webAuthUsername, *webAuthPassword, metricsHandler)
+	}
+	for _, path := range metricsPaths {
+		http.Handle(path, metricsHandler)
+	}
+	probeHandler := newProbeHandler(opts, *probeMaxTargets)
+	if *probeEnabled {
+		var probe http.Handler = probeHandler
+		if *webAuthUsername != "" {
+			probe = basicAuth(*webAuthUsername, *webAuthPassword, probe)
+		}
+		http.Handle("/probe", probe)
+	}
+	if *debugEndpoints {
+		var debug http.Handler = debugConnectorsHandler(exporters)
+		if *webAuthUsername != "" {
+			debug = basicAuth(*webAuthUsername, *webAuthPassword, debug)
+		}
+		http.Handle("/debug/connectors", debug)
+	}
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "OK")
+	})
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		for _, exporter := range exporters {
+			if !exporter.Ready() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "last scrape of %s failed\n", exporter.URI)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "OK")
+	})
+	if !*disableRootRedirect && !seenPaths["/"] {
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if *noLandingPage {
+				http.Redirect(w, r, metricsPath, http.StatusMovedPermanently)
+				return
+			}
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+
+			err := landingPage.Execute(w, struct {
+				Version     string
+				Revision    string
+				MetricsPath string
+				Exporters   []*Exporter
+			}{version, revision, metricsPath, exporters})
+			if err != nil {
+				log.Errorf("Can't render landing page: %v", err)
+			}
+		})
+	}
+
+	webTLSConfig, err := newWebTLSConfig(*webTLSCert, *webTLSKey, *webTLSClientCA)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	server := &http.Server{Addr: *listenAddress, TLSConfig: webTLSConfig}
+	serveErrors := make(chan error, 1)
+	go func() {
+		if webTLSConfig != nil {
+			serveErrors <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serveErrors <- server.ListenAndServe()
+	}()
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			values, err := reloadValues(flag.CommandLine, explicit, *configFile)
+			var reloaded Options
+			if err == nil {
+				reloaded, err = dynamicOptions(opts, values)
+			}
+			if err != nil {
+				log.Errorf("Can't reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			for _, exporter := range exporters {
+				exporter.Reload(reloaded)
+			}
+			probeHandler.reload(reloaded)
+			log.Infoln("Reloaded credentials and connector filters")
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErrors:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Infof("Received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Can't shut down gracefully: %v", err)
+		os.Exit(1)
+	}
 
 }
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeClient answers the exporter from memory. Connectors without a status
+// and without an error in statusErrs aren't known to it.
+type fakeClient struct {
+	mu            sync.Mutex
+	connectors    connectors
+	connectorsErr error
+	statuses      map[string]status
+	statusErrs    map[string]error
+	restarts      []string
+}
+
+func (f *fakeClient) ClusterInfo(ctx context.Context) (*clusterInfo, error) {
+	return &clusterInfo{Version: "3.4.0", Commit: "abc", KafkaClusterId: "xyz"}, nil
+}
+
+func (f *fakeClient) Connectors(ctx context.Context) (connectors, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connectors, f.connectorsErr
+}
+
+func (f *fakeClient) ConnectorStatus(ctx context.Context, connector string) (*status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.statusErrs[connector]; err != nil {
+		return nil, err
+	}
+	connectorStatus, ok := f.statuses[connector]
+	if !ok {
+		return nil, &statusError{code: 404, status: "404 Not Found", uri: connector}
+	}
+	return &connectorStatus, nil
+}
+
+func (f *fakeClient) ExpandedStatuses(ctx context.Context) ([]status, error) {
+	return nil, errors.New("expand isn't supported")
+}
+
+func (f *fakeClient) ConnectorTopics(ctx context.Context, connector string) ([]string, bool, error) {
+	return nil, false, nil
+}
+
+func (f *fakeClient) ConnectorConfig(ctx context.Context, connector string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeClient) Plugins(ctx context.Context) ([]plugin, error) {
+	return nil, nil
+}
+
+func (f *fakeClient) RestartConnector(ctx context.Context, connector string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.restarts = append(f.restarts, connector)
+	return nil
+}
+
+func (f *fakeClient) RestartTask(ctx context.Context, connector string, task int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.restarts = append(f.restarts, fmt.Sprintf("%s/%d", connector, task))
+	return nil
+}
+
+func testOptions() Options {
+	return Options{
+		Namespace:      "kafka_connect",
+		Timeout:        time.Second,
+		MaxConcurrency: 2,
+	}
+}
+
+func runningStatus(name string, tasks ...string) status {
+	connectorStatus := status{
+		Name:      name,
+		Connector: connector{State: "RUNNING", WorkerId: "worker-1:8083"},
+		Type:      "sink",
+	}
+	for i, state := range tasks {
+		connectorStatus.Tasks = append(connectorStatus.Tasks, task{State: state, Id: float64(i), WorkerId: "worker-1:8083"})
+	}
+	return connectorStatus
+}
+
+// gather scrapes the exporter once and returns the gauges and counters keyed
+// by name and labels, e.g. kafka_connect_connector_present{connector="a"}.
+// The cluster label is left out of the keys.
+func gather(t *testing.T, exporter *Exporter) map[string]float64 {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(exporter); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				if label.GetName() != "cluster" {
+					labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+				}
+			}
+			sort.Strings(labels)
+			key := family.GetName()
+			if len(labels) > 0 {
+				key += "{" + strings.Join(labels, ",") + "}"
+			}
+
+			switch {
+			case metric.Gauge != nil:
+				values[key] = metric.GetGauge().GetValue()
+			case metric.Counter != nil:
+				values[key] = metric.GetCounter().GetValue()
+			case metric.Untyped != nil:
+				values[key] = metric.GetUntyped().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestScrape(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  *fakeClient
+		want    map[string]float64
+		missing []string
+	}{
+		{
+			name: "success",
+			client: &fakeClient{
+				connectors: connectors{"a", "b"},
+				statuses: map[string]status{
+					"a": runningStatus("a", "RUNNING"),
+					"b": runningStatus("b", "RUNNING", "FAILED"),
+				},
+			},
+			want: map[string]float64{
+				"kafka_connect_up":                 1,
+				"kafka_connect_connectors_count":   2,
+				"kafka_connect_tasks_failed_total": 1,
+				`kafka_connect_connector_state_running{connector="a",state="running",type="sink",worker="worker-1:8083"}`: 1,
+				`kafka_connect_connector_tasks_state{connector="b",id="1",state="failed",worker_id="worker-1:8083"}`:      0,
+				`kafka_connect_connector_tasks_state{connector="b",id="0",state="running",worker_id="worker-1:8083"}`:     1,
+				`kafka_connect_connector_scrape_status{code="200",connector="a"}`:                                         1,
+				"kafka_connect_any_connector_failed": 1,
+			},
+		},
+		{
+			name:    "connectors fail",
+			client:  &fakeClient{connectorsErr: errors.New("connection refused")},
+			want:    map[string]float64{"kafka_connect_up": 0, "kafka_connect_scrape_errors_total": 1},
+			missing: []string{"kafka_connect_connectors_count"},
+		},
+		{
+			name: "non 2xx status",
+			client: &fakeClient{
+				connectors: connectors{"a", "busy"},
+				statuses:   map[string]status{"a": runningStatus("a")},
+				statusErrs: map[string]error{"busy": &statusError{code: 409, status: "409 Conflict", uri: "busy"}},
+			},
+			want: map[string]float64{
+				"kafka_connect_up":               1,
+				"kafka_connect_connectors_count": 2,
+				`kafka_connect_connector_scrape_status{code="409",connector="busy"}`: 1,
+				`kafka_connect_connector_scrape_errors_total{connector="busy"}`:      1,
+				`kafka_connect_connector_tasks_count{connector="a"}`:                 0,
+			},
+			missing: []string{`kafka_connect_connector_tasks_count{connector="busy"}`},
+		},
+		{
+			name: "malformed status",
+			client: &fakeClient{
+				connectors: connectors{"a", "broken"},
+				statuses:   map[string]status{"a": runningStatus("a")},
+				statusErrs: map[string]error{"broken": &decodeError{code: 200, uri: "broken", err: errors.New("unexpected EOF")}},
+			},
+			want: map[string]float64{
+				"kafka_connect_up": 1,
+				`kafka_connect_connector_scrape_status{code="200",connector="broken"}`: 1,
+				`kafka_connect_connector_scrape_errors_total{connector="broken"}`:      1,
+			},
+			missing: []string{`kafka_connect_connector_tasks_count{connector="broken"}`},
+		},
+		{
+			name: "partial failure",
+			client: &fakeClient{
+				connectors: connectors{"a", "b", "c"},
+				statuses:   map[string]status{"a": runningStatus("a", "RUNNING"), "c": runningStatus("c")},
+				statusErrs: map[string]error{"b": errors.New("timeout")},
+			},
+			want: map[string]float64{
+				"kafka_connect_up":                                           1,
+				"kafka_connect_connectors_count":                             3,
+				"kafka_connect_tasks_running_total":                          1,
+				`kafka_connect_connector_scrape_errors_total{connector="b"}`: 1,
+				`kafka_connect_connector_tasks_count{connector="a"}`:         1,
+				`kafka_connect_connector_tasks_count{connector="c"}`:         0,
+			},
+			missing: []string{
+				`kafka_connect_connector_tasks_count{connector="b"}`,
+				`kafka_connect_connector_scrape_status{code="0",connector="b"}`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := gather(t, NewExporterWithClient(test.client, "test", testOptions()))
+			for key, want := range test.want {
+				got, ok := values[key]
+				if !ok {
+					t.Errorf("%s is missing", key)
+				} else if got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+			for _, key := range test.missing {
+				if _, ok := values[key]; ok {
+					t.Errorf("%s is exported, want it missing", key)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyAfterScrape(t *testing.T) {
+	client := &fakeClient{connectors: connectors{}}
+	exporter := NewExporterWithClient(client, "test", testOptions())
+	if exporter.Ready() {
+		t.Fatal("ready before the first scrape")
+	}
+
+	gather(t, exporter)
+	if !exporter.Ready() {
+		t.Fatal("not ready after a successful scrape")
+	}
+
+	client.mu.Lock()
+	client.connectorsErr = errors.New("connection refused")
+	client.mu.Unlock()
+	gather(t, exporter)
+	if exporter.Ready() {
+		t.Fatal("ready after a failed scrape")
+	}
+}
+
+func TestConnectorsCountNotStale(t *testing.T) {
+	client := &fakeClient{
+		connectors: connectors{"a", "b"},
+		statuses:   map[string]status{"a": runningStatus("a"), "b": runningStatus("b")},
+	}
+	exporter := NewExporterWithClient(client, "test", testOptions())
+
+	values := gather(t, exporter)
+	if values["kafka_connect_up"] != 1 || values["kafka_connect_connectors_count"] != 2 {
+		t.Fatalf("got up %v and connectors_count %v after a successful scrape, want 1 and 2",
+			values["kafka_connect_up"], values["kafka_connect_connectors_count"])
+	}
+
+	client.mu.Lock()
+	client.connectorsErr = errors.New("connection refused")
+	client.mu.Unlock()
+	values = gather(t, exporter)
+	if values["kafka_connect_up"] != 0 {
+		t.Fatalf("got up %v after a failed scrape, want 0", values["kafka_connect_up"])
+	}
+	if count, ok := values["kafka_connect_connectors_count"]; ok {
+		t.Fatalf("connectors_count %v is exported after a failed scrape", count)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"scrape-uri": "http://127.0.0.1:8080", "listen-address": ":8080", "max-concurrency": "10"},
+		},
+		{
+			name: "env over default",
+			env:  map[string]string{"KAFKA_CONNECT_SCRAPE_URI": "http://connect:8083", "KAFKA_CONNECT_MAX_CONCURRENCY": "3"},
+			want: map[string]string{"scrape-uri": "http://connect:8083", "listen-address": ":8080", "max-concurrency": "3"},
+		},
+		{
+			name: "flag over env",
+			args: []string{"-scrape-uri", "http://flag:8083"},
+			env:  map[string]string{"KAFKA_CONNECT_SCRAPE_URI": "http://connect:8083", "KAFKA_CONNECT_LISTEN_ADDRESS": ":9000"},
+			want: map[string]string{"scrape-uri": "http://flag:8083", "listen-address": ":9000"},
+		},
+		{
+			name: "dots in flag names",
+			env:  map[string]string{"KAFKA_CONNECT_LOG_LEVEL": "debug"},
+			want: map[string]string{"log.level": "debug"},
+		},
+		{
+			name:    "invalid env value",
+			env:     map[string]string{"KAFKA_CONNECT_MAX_CONCURRENCY": "many"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.String("scrape-uri", "http://127.0.0.1:8080", "")
+			flags.String("listen-address", ":8080", "")
+			flags.String("log.level", "info", "")
+			flags.Int("max-concurrency", 10, "")
+			if err := flags.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, value := range test.env {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+
+			err := applyEnv(flags)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("invalid env value was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range test.want {
+				if got := flags.Lookup(name).Value.String(); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTaskStates(t *testing.T) {
+	tests := []struct {
+		state string
+		code  float64
+		label string
+	}{
+		{"RUNNING", 1, "running"},
+		{"FAILED", 0, "failed"},
+		{"UNASSIGNED", 2, "unassigned"},
+		{"PAUSED", 3, "paused"},
+		{"RESTARTING", 4, "restarting"},
+		{"DESTROYED", 5, "destroyed"},
+		{"running", 1, "running"},
+		{"STOPPED", 0, "stopped"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			client := &fakeClient{
+				connectors: connectors{"a"},
+				statuses:   map[string]status{"a": runningStatus("a", test.state)},
+			}
+			values := gather(t, NewExporterWithClient(client, "test", testOptions()))
+
+			key := fmt.Sprintf(`kafka_connect_connector_tasks_state{connector="a",id="0",state=%q,worker_id="worker-1:8083"}`, test.label)
+			if got, ok := values[key]; !ok || got != test.code {
+				t.Errorf("%s = %v (exported %v), want %v", key, got, ok, test.code)
+			}
+
+			for _, taskState := range append(append([]string{}, taskStates...), test.label) {
+				want := 0.0
+				if taskState == test.label {
+					want = 1
+				}
+				key := fmt.Sprintf(`kafka_connect_connector_task_state{connector="a",id="0",state=%q}`, taskState)
+				if got, ok := values[key]; !ok || got != want {
+					t.Errorf("%s = %v (exported %v), want %v", key, got, ok, want)
+				}
+			}
+
+			for _, taskState := range taskStates {
+				want := 0.0
+				if taskState == test.label {
+					want = 1
+				}
+				key := fmt.Sprintf("kafka_connect_tasks_%s_total", taskState)
+				if got := values[key]; got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTaskStateHelp(t *testing.T) {
+	want := "0-failed, 1-running, 2-unassigned, 3-paused, 4-restarting, 5-destroyed"
+	if got := taskStateHelp(taskStateCodes); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestConnectorPresent(t *testing.T) {
+	tests := []struct {
+		name  string
+		lists []connectors
+		// want holds connector_present per scrape, connectors missing from
+		// it must not be exported.
+		want []map[string]float64
+	}{
+		{
+			name:  "removed connector reports 0 once",
+			lists: []connectors{{"a", "b"}, {"a"}, {"a"}},
+			want:  []map[string]float64{{"a": 1, "b": 1}, {"a": 1, "b": 0}, {"a": 1}},
+		},
+		{
+			name:  "added connector",
+			lists: []connectors{{"a"}, {"a", "b"}},
+			want:  []map[string]float64{{"a": 1}, {"a": 1, "b": 1}},
+		},
+		{
+			name:  "removed and added again",
+			lists: []connectors{{"a", "b"}, {"a"}, {"a", "b"}, {"b"}},
+			want:  []map[string]float64{{"a": 1, "b": 1}, {"a": 1, "b": 0}, {"a": 1, "b": 1}, {"a": 0, "b": 1}},
+		},
+		{
+			name:  "all removed",
+			lists: []connectors{{"a", "b"}, {}, {}},
+			want:  []map[string]float64{{"a": 1, "b": 1}, {"a": 0, "b": 0}, {}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeClient{statuses: map[string]status{"a": runningStatus("a"), "b": runningStatus("b")}}
+			exporter := NewExporterWithClient(client, "test", testOptions())
+
+			for i, list := range test.lists {
+				client.mu.Lock()
+				client.connectors = list
+				client.mu.Unlock()
+				values := gather(t, exporter)
+
+				for _, name := range []string{"a", "b"} {
+					key := fmt.Sprintf(`kafka_connect_connector_present{connector=%q}`, name)
+					got, exported := values[key]
+					want, wanted := test.want[i][name]
+					if exported != wanted || got != want {
+						t.Errorf("scrape %d: %s = %v (exported %v), want %v (exported %v)", i+1, key, got, exported, want, wanted)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTaskFields(t *testing.T) {
+	payload := `{
+		"name": "orders-sink",
+		"connector": {"state": "RUNNING", "worker_id": "worker-1:8083"},
+		"tasks": [
+			{"id": 0, "state": "RUNNING", "worker_id": "worker-1:8083", "offset": 123456, "lag": 42.5, "version": "7.4.0", "leader": true, "extra": {"nested": 1}, "restarts": null},
+			{"id": 1, "state": "FAILED", "worker_id": "worker-2:8083", "trace": "org.apache.kafka.connect.errors.ConnectException: boom"}
+		],
+		"type": "sink"
+	}`
+
+	var connectorStatus status
+	if err := json.Unmarshal([]byte(payload), &connectorStatus); err != nil {
+		t.Fatal(err)
+	}
+	if len(connectorStatus.Tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2", len(connectorStatus.Tasks))
+	}
+	first, second := connectorStatus.Tasks[0], connectorStatus.Tasks[1]
+	if first.State != "RUNNING" || first.Id != 0 || first.WorkerId != "worker-1:8083" {
+		t.Fatalf("known fields of the first task got lost: %+v", first)
+	}
+	if want := (map[string]float64{"offset": 123456, "lag": 42.5}); !reflect.DeepEqual(first.Fields, want) {
+		t.Fatalf("got fields %v, want %v", first.Fields, want)
+	}
+	if second.Fields != nil || second.Trace == "" || second.Id != 1 {
+		t.Fatalf("got %+v for a task without extra fields", second)
+	}
+
+	client := &fakeClient{
+		connectors: connectors{"orders-sink"},
+		statuses:   map[string]status{"orders-sink": connectorStatus},
+	}
+	values := gather(t, NewExporterWithClient(client, "test", testOptions()))
+	for key, want := range map[string]float64{
+		`kafka_connect_connector_task_field{connector="orders-sink",field="offset",id="0"}`: 123456,
+		`kafka_connect_connector_task_field{connector="orders-sink",field="lag",id="0"}`:    42.5,
+	} {
+		if got, ok := values[key]; !ok || got != want {
+			t.Errorf("%s = %v (exported %v), want %v", key, got, ok, want)
+		}
+	}
+	for key := range values {
+		if strings.HasPrefix(key, "kafka_connect_connector_task_field{") && strings.Contains(key, `id="1"`) {
+			t.Errorf("%s is exported for a task without extra fields", key)
+		}
+	}
+}
+
+// blockingClient holds Connectors until release is closed.
+type blockingClient struct {
+	*fakeClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingClient) Connectors(ctx context.Context) (connectors, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.fakeClient.Connectors(ctx)
+}
+
+func TestReadyDuringScrape(t *testing.T) {
+	client := &blockingClient{
+		fakeClient: &fakeClient{connectors: connectors{}},
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	exporter := NewExporterWithClient(client, "test", testOptions())
+
+	go func() {
+		<-client.started
+		close(client.release)
+	}()
+	gather(t, exporter)
+
+	client.release = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		// t.Fatal can't be called from here, the exporter is collected
+		// without a registry.
+		metrics := make(chan prometheus.Metric)
+		go func() {
+			exporter.Collect(metrics)
+			close(metrics)
+		}()
+		for range metrics {
+		}
+		close(done)
+	}()
+	<-client.started
+	if !exporter.Ready() {
+		t.Error("not ready while the next scrape is running")
+	}
+	close(client.release)
+	<-done
+	if !exporter.Ready() {
+		t.Error("not ready after the next scrape succeeded")
+	}
+}
+
+// cancelClient waits for the caller to give up while block names the call,
+// "connectors" or "status", then fails with the error of the context.
+type cancelClient struct {
+	*fakeClient
+	block   string
+	started chan struct{}
+}
+
+func (c *cancelClient) wait(ctx context.Context, call string) error {
+	c.mu.Lock()
+	block := c.block
+	c.mu.Unlock()
+	if block != call {
+		return nil
+	}
+	c.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *cancelClient) Connectors(ctx context.Context) (connectors, error) {
+	if err := c.wait(ctx, "connectors"); err != nil {
+		return nil, err
+	}
+	return c.fakeClient.Connectors(ctx)
+}
+
+func (c *cancelClient) ConnectorStatus(ctx context.Context, connector string) (*status, error) {
+	if err := c.wait(ctx, "status"); err != nil {
+		return nil, err
+	}
+	return c.fakeClient.ConnectorStatus(ctx, connector)
+}
+
+func TestAbandonedScrape(t *testing.T) {
+	for _, block := range []string{"connectors", "status"} {
+		t.Run(block, func(t *testing.T) {
+			client := &cancelClient{
+				fakeClient: &fakeClient{
+					connectors: connectors{"a"},
+					statuses:   map[string]status{"a": runningStatus("a")},
+				},
+				started: make(chan struct{}),
+			}
+			exporter := NewExporterWithClient(client, "test", testOptions())
+			gather(t, exporter)
+
+			client.mu.Lock()
+			client.block = block
+			client.mu.Unlock()
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				metrics := make(chan prometheus.Metric)
+				go func() {
+					(&contextCollector{ctx: ctx, exporter: exporter}).Collect(metrics)
+					close(metrics)
+				}()
+				for range metrics {
+				}
+				close(done)
+			}()
+			<-client.started
+			cancel()
+			<-done
+
+			if !exporter.Ready() {
+				t.Error("not ready after an abandoned scrape")
+			}
+
+			client.mu.Lock()
+			client.block = ""
+			client.mu.Unlock()
+			values := gather(t, exporter)
+			if got := values["kafka_connect_scrape_errors_total"]; got != 0 {
+				t.Errorf("scrape_errors_total = %v after an abandoned scrape, want 0", got)
+			}
+			if got, ok := values[`kafka_connect_connector_scrape_errors_total{connector="a"}`]; ok {
+				t.Errorf("connector_scrape_errors_total = %v after an abandoned scrape, want none", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// probeHandler serves /probe?target=<uri>, scraping the given kafka connect
+// instead of the configured ones. Exporters are kept per target so counters
+// and state history survive between probes, up to maxTargets of them.
+type probeHandler struct {
+	opts       Options
+	maxTargets int
+	mu         sync.Mutex
+	targets    map[string]*probeTarget
+}
+
+type probeTarget struct {
+	exporter *Exporter
+	used     time.Time
+}
+
+func newProbeHandler(opts Options, maxTargets int) *probeHandler {
+	// Targets come from the query string, restarts only ever go to the
+	// configured clusters.
+	opts.AutoRestart = false
+	return &probeHandler{opts: opts, maxTargets: maxTargets, targets: map[string]*probeTarget{}}
+}
+
+// normalizeTarget reduces target to scheme://host/path, so spellings of the
+// same kafka connect share one exporter. Credentials and query strings of
+// the target are dropped, only the shared flags apply.
+func normalizeTarget(target string) (*url.URL, error) {
+	uri, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	scheme := strings.ToLower(uri.Scheme)
+	// Sockets are local files, targets from the query string can't use them.
+	if !supportedSchema[scheme] || scheme == "unix" || uri.Host == "" {
+		return nil, fmt.Errorf("schema not supported: %s", target)
+	}
+
+	return &url.URL{
+		Scheme: scheme,
+		Host:   strings.ToLower(uri.Host),
+		Path:   strings.TrimRight(uri.Path, "/"),
+	}, nil
+}
+
+func (p *probeHandler) exporter(target string) (*Exporter, error) {
+	uri, err := normalizeTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	key := uri.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cached, ok := p.targets[key]; ok {
+		cached.used = time.Now()
+		return cached.exporter, nil
+	}
+
+	if len(p.targets) >= p.maxTargets {
+		p.evictOldest()
+	}
+	exporter := NewExporter(uri, uri.Host, p.opts)
+	p.targets[key] = &probeTarget{exporter: exporter, used: time.Now()}
+	return exporter, nil
+}
+
+// evictOldest drops the target probed least recently.
+func (p *probeHandler) evictOldest() {
+	var oldest string
+	for key, target := range p.targets {
+		if oldest == "" || target.used.Before(p.targets[oldest].used) {
+			oldest = key
+		}
+	}
+	if client, ok := p.targets[oldest].exporter.client.(*connectClient); ok {
+		client.client.CloseIdleConnections()
+	}
+	delete(p.targets, oldest)
+}
+
+// reload applies the reloaded credentials and filters to future and
+// existing probe exporters. Exporters wait for their scrape in progress to
+// reload, which happens without the lock so probes go on meanwhile.
+func (p *probeHandler) reload(opts Options) {
+	p.mu.Lock()
+	p.opts = opts
+	p.opts.AutoRestart = false
+	exporters := make([]*Exporter, 0, len(p.targets))
+	for _, target := range p.targets {
+		exporters = append(exporters, target.exporter)
+	}
+	p.mu.Unlock()
+
+	for _, exporter := range exporters {
+		exporter.Reload(opts)
+	}
+}
+
+func (p *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	exporter, err := p.exporter(target)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid target: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	exportersHandler(prometheus.Gatherers{}, exporter).ServeHTTP(w, r)
+}
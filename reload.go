@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+)
+
+// reloadable are the flags whose values a SIGHUP applies again, after
+// re-reading the config file.
+var reloadable = []string{
+	"scrape-username",
+	"scrape-password",
+	"scrape-password-file",
+	"scrape-bearer-token",
+	"scrape-bearer-token-file",
+	"confluent-api-key",
+	"confluent-api-secret",
+	"connector-include",
+	"connector-exclude",
+}
+
+// dynamicOptions returns opts with the credentials and connector filters
+// taken from the reloadable flag values.
+func dynamicOptions(opts Options, value func(name string) string) (Options, error) {
+	username, password, passwordFile := value("scrape-username"), value("scrape-password"), value("scrape-password-file")
+	token, tokenFile := value("scrape-bearer-token"), value("scrape-bearer-token-file")
+	apiKey, apiSecret := value("confluent-api-key"), value("confluent-api-secret")
+
+	if password != "" && passwordFile != "" {
+		return opts, fmt.Errorf("scrape-password and scrape-password-file are mutually exclusive")
+	}
+	if (username == "") != (password == "" && passwordFile == "") {
+		return opts, fmt.Errorf("scrape-username and scrape-password or scrape-password-file must be set together")
+	}
+	if (apiKey == "") != (apiSecret == "") {
+		return opts, fmt.Errorf("confluent-api-key and confluent-api-secret must be set together")
+	}
+	if apiKey != "" && (username != "" || token != "" || tokenFile != "") {
+		return opts, fmt.Errorf("confluent-api-key can't be combined with scrape-username or a bearer token")
+	}
+	if token != "" && tokenFile != "" {
+		return opts, fmt.Errorf("scrape-bearer-token and scrape-bearer-token-file are mutually exclusive")
+	}
+	if username != "" && (token != "" || tokenFile != "") {
+		return opts, fmt.Errorf("basic auth and bearer token auth are mutually exclusive")
+	}
+
+	var include, exclude *regexp.Regexp
+	var err error
+	if pattern := value("connector-include"); pattern != "" {
+		if include, err = regexp.Compile(pattern); err != nil {
+			return opts, fmt.Errorf("invalid connector-include: %v", err)
+		}
+	}
+	if pattern := value("connector-exclude"); pattern != "" {
+		if exclude, err = regexp.Compile(pattern); err != nil {
+			return opts, fmt.Errorf("invalid connector-exclude: %v", err)
+		}
+	}
+
+	opts.Username, opts.Password, opts.PasswordFile = username, password, passwordFile
+	opts.BearerToken, opts.BearerTokenFile = token, tokenFile
+	opts.Managed = apiKey != ""
+	if opts.Managed {
+		opts.Username, opts.Password = apiKey, apiSecret
+	}
+	opts.Include, opts.Exclude = include, exclude
+
+	return opts, nil
+}
+
+// reloadValues returns the reloadable flag values with the config file at
+// path read again. Flags given on the command line or through the
+// environment keep their value, the others fall back to their default when
+// the file no longer sets them.
+func reloadValues(flags *flag.FlagSet, explicit map[string]bool, path string) (func(name string) string, error) {
+	values := make(map[string]string, len(reloadable))
+	for _, name := range reloadable {
+		f := flags.Lookup(name)
+		if explicit[name] || path == "" {
+			values[name] = f.Value.String()
+		} else {
+			values[name] = f.DefValue
+		}
+	}
+
+	if path != "" {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range cfg.flagValues() {
+			if _, ok := values[name]; ok && !explicit[name] {
+				values[name] = value[len(value)-1]
+			}
+		}
+	}
+
+	return func(name string) string { return values[name] }, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newWebTLSConfig returns the TLS config of the exporter's own HTTP server,
+// or nil when it should serve plain HTTP.
+func newWebTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("web.tls-cert and web.tls-key must be set together")
+	}
+	if certFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("web.tls-client-ca requires web.tls-cert and web.tls-key")
+		}
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't load web certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// basicAuth protects next with HTTP basic auth. Credentials are hashed before
+// the constant time comparison so their length doesn't leak either.
+func basicAuth(username, password string, next http.Handler) http.Handler {
+	wantUsername := sha256.Sum256([]byte(username))
+	wantPassword := sha256.Sum256([]byte(password))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUsername, gotPassword, ok := r.BasicAuth()
+		if ok {
+			usernameHash := sha256.Sum256([]byte(gotUsername))
+			passwordHash := sha256.Sum256([]byte(gotPassword))
+			usernameMatch := subtle.ConstantTimeCompare(usernameHash[:], wantUsername[:])
+			passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], wantPassword[:])
+			if usernameMatch&passwordMatch == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="kafka_connect_exporter"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// exportersHandler serves the metrics of gatherer together with those of the
+// exporters, which are collected within the context of each request.
+func exportersHandler(gatherer prometheus.Gatherer, exporters ...*Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry := prometheus.NewRegistry()
+		for _, exporter := range exporters {
+			registry.MustRegister(&contextCollector{ctx: r.Context(), exporter: exporter})
+		}
+		promhttp.HandlerFor(prometheus.Gatherers{gatherer, registry}, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+	})
+}